@@ -0,0 +1,64 @@
+package allocator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// ErrExhausted 地址池中没有空闲的IP了
+var ErrExhausted = errors.New("no IP addresses available")
+
+type IPAllocator struct {
+	pool *Pool
+}
+
+func NewIPAllocator(pool *Pool) *IPAllocator {
+	return &IPAllocator{
+		pool: pool,
+	}
+}
+
+// Get 从RangeStart开始顺序找出第一个没有被占用的IP
+// used是已经分配出去的IP，跳过网关和Exclude中的地址
+func (a *IPAllocator) Get(used []net.IP) (net.IP, error) {
+	usedSet := make(map[string]bool, len(used))
+	for _, u := range used {
+		usedSet[canonicalIP(u).String()] = true
+	}
+
+	for cur := a.pool.RangeStart; ; cur = ip.NextIP(cur) {
+		if !usedSet[cur.String()] && a.pool.Allocatable(cur) {
+			return canonicalIP(cur), nil
+		}
+		if cur.Equal(a.pool.RangeEnd) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%w in pool %s", ErrExhausted, a.pool.String())
+}
+
+// Free 返回地址池中还没有被占用的IP，最多返回limit个，limit<=0时不限制
+// 用于展示剩余地址，IPv6大网段一定要传limit
+func (a *IPAllocator) Free(used []net.IP, limit int) []net.IP {
+	usedSet := make(map[string]bool, len(used))
+	for _, u := range used {
+		usedSet[canonicalIP(u).String()] = true
+	}
+
+	var free []net.IP
+	for cur := a.pool.RangeStart; ; cur = ip.NextIP(cur) {
+		if !usedSet[cur.String()] && a.pool.Allocatable(cur) {
+			free = append(free, canonicalIP(cur))
+			if limit > 0 && len(free) >= limit {
+				break
+			}
+		}
+		if cur.Equal(a.pool.RangeEnd) {
+			break
+		}
+	}
+	return free
+}
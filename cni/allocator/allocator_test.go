@@ -0,0 +1,125 @@
+package allocator_test
+
+import (
+	"net"
+
+	"ts-cni/cni/allocator"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func mustLoadPool(name string, value string) *allocator.Pool {
+	p, err := allocator.LoadPool(name, value)
+	Expect(err).NotTo(HaveOccurred())
+	return p
+}
+
+var _ = Describe("tc-cni allocator", func() {
+	It("should treat a bare vlan value as a legacy /24 pool", func() {
+		p := mustLoadPool("192.168.10.0", "100")
+		Expect(p.VlanId).To(Equal("100"))
+		Expect(p.IPNet().String()).To(Equal("192.168.10.0/24"))
+		Expect(p.RangeStart).To(Equal(net.IP{192, 168, 10, 11}))
+		Expect(p.RangeEnd).To(Equal(net.IP{192, 168, 10, 250}))
+		Expect(p.Gateway).To(Equal(net.IP{192, 168, 10, 254}))
+
+		ip, err := allocator.NewIPAllocator(p).Get(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("192.168.10.11"))
+	})
+
+	It("should allocate across octet boundaries for non-/24 prefixes", func() {
+		p := mustLoadPool("app", `{"subnet":"10.1.0.0/22","rangeStart":"10.1.0.254","vlan":"200"}`)
+		used := []net.IP{net.ParseIP("10.1.0.254"), net.ParseIP("10.1.0.255")}
+
+		ip, err := allocator.NewIPAllocator(p).Get(used)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip).To(Equal(net.IP{10, 1, 1, 0}))
+	})
+
+	It("should skip the gateway and excluded ranges", func() {
+		p := mustLoadPool("app", `{
+			"subnet": "10.2.0.0/28",
+			"gateway": "10.2.0.1",
+			"exclude": [{"start": "10.2.0.2", "end": "10.2.0.4"}, {"start": "10.2.0.6"}]
+		}`)
+		a := allocator.NewIPAllocator(p)
+
+		ip, err := a.Get(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("10.2.0.5"))
+
+		ip, err = a.Get([]net.IP{ip})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("10.2.0.7"))
+
+		free := a.Free(nil, 0)
+		Expect(free).To(HaveLen(9))
+	})
+
+	It("should fail when the pool is exhausted", func() {
+		p := mustLoadPool("app", `{"subnet":"10.3.0.0/30"}`)
+		_, err := allocator.NewIPAllocator(p).Get([]net.IP{net.ParseIP("10.3.0.2")})
+		Expect(err).To(MatchError(ContainSubstring("no IP addresses available")))
+	})
+
+	It("should allocate from IPv6 prefixes", func() {
+		p := mustLoadPool("v6", `{"subnet":"2001:db8:1::/64","gateway":"2001:db8:1::1"}`)
+		ip, err := allocator.NewIPAllocator(p).Get([]net.IP{net.ParseIP("2001:db8:1::2")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("2001:db8:1::3"))
+	})
+
+	It("should reject excludes outside of the subnet", func() {
+		_, err := allocator.LoadPool("app", `{"subnet":"10.4.0.0/24","exclude":[{"start":"10.5.0.1"}]}`)
+		Expect(err).To(MatchError(ContainSubstring("not in network")))
+	})
+
+	It("should count allocatable addresses without the gateway and excludes", func() {
+		// legacy: .11-.250，网关.254不在range内
+		Expect(mustLoadPool("192.168.10.0", "100").Capacity().Int64()).To(Equal(int64(240)))
+
+		p := mustLoadPool("app", `{"subnet":"10.1.0.0/24","vlan":"200",
+			"exclude":[{"start":"10.1.0.10","end":"10.1.0.19"},{"start":"10.1.0.15","end":"10.1.0.24"},{"start":"10.1.0.1"}]}`)
+		// .1-.254去掉网关.1和.10-.24
+		Expect(p.Capacity().Int64()).To(Equal(int64(254 - 1 - 15)))
+
+		v6 := mustLoadPool("v6", `{"subnet":"fd00::/64","vlan":"300"}`)
+		Expect(v6.Capacity().String()).To(Equal("18446744073709551614"))
+	})
+
+	It("should derive a stable mac from the pod IP", func() {
+		mac, err := allocator.MacFromIP("", net.ParseIP("10.1.0.5"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:0a:01:00:05"))
+
+		mac, err = allocator.MacFromIP("02:42:ac", net.ParseIP("10.1.0.5"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("02:42:ac:01:00:05"))
+
+		mac, err = allocator.MacFromIP("", net.ParseIP("fd00::1:2:3"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal("0a:58:00:02:00:03"))
+
+		_, err = allocator.MacFromIP("01:00:5e", net.ParseIP("10.1.0.5"))
+		Expect(err).To(MatchError(ContainSubstring("unicast")))
+		_, err = allocator.LoadPool("app", `{"subnet":"10.4.0.0/24","macPrefix":"0a:58:0a:01:00:05"}`)
+		Expect(err).To(MatchError(ContainSubstring("1 to 5 bytes")))
+	})
+
+	It("should reject a mac prefix too long for the pool subnet", func() {
+		// 3字节前缀只剩24位，/16需要16位可以，/7需要25位放不下
+		_, err := allocator.LoadPool("app", `{"subnet":"10.4.0.0/16","macPrefix":"02:42:ac"}`)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = allocator.LoadPool("app", `{"subnet":"10.0.0.0/7","macPrefix":"02:42:ac"}`)
+		Expect(err).To(MatchError(ContainSubstring("host bits")))
+		_, err = allocator.LoadPool("v6", `{"subnet":"fd00::/64","vlan":"300","macPrefix":"0a:58"}`)
+		Expect(err).To(MatchError(ContainSubstring("host bits")))
+
+		_, subnet, _ := net.ParseCIDR("fd00::/96")
+		Expect(allocator.CheckMacPrefix("", subnet)).To(Succeed())
+		_, subnet, _ = net.ParseCIDR("fd00::/64")
+		Expect(allocator.CheckMacPrefix("", subnet)).NotTo(Succeed())
+	})
+})
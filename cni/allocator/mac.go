@@ -0,0 +1,68 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultMacPrefix 从IP生成MAC时默认的前缀，0a是本地管理的单播地址，后面接IPv4的4个字节
+const DefaultMacPrefix = "0a:58"
+
+// ParseMacPrefix 解析MAC前缀，例如 0a:58 或 02:42:ac，长度1到5个字节，不能是组播地址
+func ParseMacPrefix(s string) ([]byte, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 1 || len(parts) > 5 {
+		return nil, fmt.Errorf("invalid mac prefix %q, must be 1 to 5 bytes", s)
+	}
+	prefix := make([]byte, len(parts))
+	for i, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) == 0 || len(part) > 2 {
+			return nil, fmt.Errorf("invalid mac prefix %q", s)
+		}
+		prefix[i] = byte(b)
+	}
+	if prefix[0]&0x01 != 0 {
+		return nil, fmt.Errorf("invalid mac prefix %q, must be unicast", s)
+	}
+	return prefix, nil
+}
+
+// CheckMacPrefix 检查前缀后面剩下的字节能不能放下subnet的主机位，放不下时不同的IP会生成同一个MAC
+// prefix为空时检查DefaultMacPrefix
+func CheckMacPrefix(prefix string, subnet *net.IPNet) error {
+	if prefix == "" {
+		prefix = DefaultMacPrefix
+	}
+	p, err := ParseMacPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	ones, bits := subnet.Mask.Size()
+	if hostBits, left := bits-ones, 8*(6-len(p)); hostBits > left {
+		return fmt.Errorf("mac prefix %q leaves %d bits for the IP, but %s has %d host bits", prefix, left, subnet, hostBits)
+	}
+	return nil
+}
+
+// MacFromIP 用前缀加IP的低位字节拼出固定的MAC，同一个IP总是得到同一个MAC
+// prefix为空时使用DefaultMacPrefix，地址池的主机位要能放进剩下的字节，见CheckMacPrefix
+func MacFromIP(prefix string, addr net.IP) (net.HardwareAddr, error) {
+	if prefix == "" {
+		prefix = DefaultMacPrefix
+	}
+	p, err := ParseMacPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	addr = canonicalIP(addr)
+	if addr == nil {
+		return nil, fmt.Errorf("no IP to generate mac from")
+	}
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, p)
+	copy(mac[len(p):], addr[len(addr)-(6-len(p)):])
+	return mac, nil
+}
@@ -0,0 +1,232 @@
+package allocator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ip"
+	hostlocal "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+// Pool 一个app_net地址池
+// subnet/rangeStart/rangeEnd/gateway的语义和host-local的Range一样，另外可以排除一部分地址
+type Pool struct {
+	hostlocal.Range
+	Name    string         `json:"name,omitempty"`
+	VlanId  string         `json:"vlan,omitempty"`
+	Exclude []ExcludeRange `json:"exclude,omitempty"`
+	// Pair 双栈时配对的另一个地址族的地址池名字，两个地址池必须在同一个VLAN
+	Pair string `json:"pair,omitempty"`
+	// 地址池所在VLAN的master网卡、子接口MTU和macvlan/ipvlan模式，为空时使用NetConf中的配置
+	Master string `json:"master,omitempty"`
+	MTU    int    `json:"mtu,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	// NodeSelector 只有label匹配的节点才使用这个地址池
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// MacPrefix NetConf中macMode为ip时，这个地址池的pod MAC使用的前缀，为空时使用NetConf中的macPrefix
+	MacPrefix string `json:"macPrefix,omitempty"`
+}
+
+// ExcludeRange 不参与分配的地址段，End为空时只排除Start一个地址
+type ExcludeRange struct {
+	Start net.IP `json:"start"`
+	End   net.IP `json:"end,omitempty"`
+}
+
+// LoadPool 解析etcd中/ipam/<name>的值
+// 新格式是Pool的json; 老格式的值只有VLAN ID，此时按 <name>/24、.11-.250、网关.254 处理
+func LoadPool(name string, value string) (*Pool, error) {
+	var p *Pool
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		p = &Pool{}
+		if err := json.Unmarshal([]byte(value), p); err != nil {
+			return nil, fmt.Errorf("failed to parse pool %q: %v", name, err)
+		}
+		if p.Name == "" {
+			p.Name = name
+		}
+	} else {
+		var err error
+		p, err = legacyPool(name, strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.Canonicalize(); err != nil {
+		return nil, fmt.Errorf("invalid pool %q: %v", name, err)
+	}
+	return p, nil
+}
+
+func legacyPool(name string, vlanId string) (*Pool, error) {
+	netIP := net.ParseIP(name).To4()
+	if netIP == nil {
+		return nil, fmt.Errorf("pool %q 不是json格式，也不是IPv4网段", name)
+	}
+	mask := net.CIDRMask(24, 32)
+	network := netIP.Mask(mask)
+	return &Pool{
+		Range: hostlocal.Range{
+			Subnet:     types.IPNet{IP: network, Mask: mask},
+			RangeStart: net.IPv4(network[0], network[1], network[2], 11).To4(),
+			RangeEnd:   net.IPv4(network[0], network[1], network[2], 250).To4(),
+			Gateway:    net.IPv4(network[0], network[1], network[2], 254).To4(),
+		},
+		Name:   name,
+		VlanId: vlanId,
+	}, nil
+}
+
+// Canonicalize 补全默认值并检查地址池配置是否合法
+func (p *Pool) Canonicalize() error {
+	if err := p.Range.Canonicalize(); err != nil {
+		return err
+	}
+	subnet := net.IPNet(p.Subnet)
+	for i := range p.Exclude {
+		e := &p.Exclude[i]
+		if e.Start == nil {
+			return fmt.Errorf("exclude range %d has no start", i)
+		}
+		if e.End == nil {
+			e.End = e.Start
+		}
+		if !sameFamily(e.Start, p.Subnet.IP) || !sameFamily(e.End, p.Subnet.IP) {
+			return fmt.Errorf("exclude range %s-%s is not the same family as %s", e.Start, e.End, subnet.String())
+		}
+		e.Start = canonicalIP(e.Start)
+		e.End = canonicalIP(e.End)
+		if !subnet.Contains(e.Start) || !subnet.Contains(e.End) {
+			return fmt.Errorf("exclude range %s-%s not in network %s", e.Start, e.End, subnet.String())
+		}
+		if ip.Cmp(e.Start, e.End) > 0 {
+			return fmt.Errorf("exclude range start %s is after end %s", e.Start, e.End)
+		}
+	}
+	if p.MacPrefix != "" {
+		if err := CheckMacPrefix(p.MacPrefix, &subnet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IPNet 地址池的网段
+func (p *Pool) IPNet() *net.IPNet {
+	subnet := net.IPNet(p.Subnet)
+	return &subnet
+}
+
+// Excluded 判断IP是否在排除列表里
+func (p *Pool) Excluded(addr net.IP) bool {
+	addr = canonicalIP(addr)
+	for _, e := range p.Exclude {
+		if ip.Cmp(addr, e.Start) >= 0 && ip.Cmp(addr, e.End) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Allocatable 判断IP是否可以分配给pod: 在range内，不是网关，也没有被排除
+func (p *Pool) Allocatable(addr net.IP) bool {
+	if !p.Contains(addr) {
+		return false
+	}
+	if p.Gateway != nil && p.Gateway.Equal(addr) {
+		return false
+	}
+	return !p.Excluded(addr)
+}
+
+// IsIPv6 地址池是不是IPv6的
+func (p *Pool) IsIPv6() bool {
+	return p.Subnet.IP.To4() == nil
+}
+
+// CheckPair 检查双栈配对的地址池: 地址族不同，VLAN相同
+func (p *Pool) CheckPair(pair *Pool) error {
+	if p.IsIPv6() == pair.IsIPv6() {
+		return fmt.Errorf("pool %s and its pair %s are the same address family", p.Name, pair.Name)
+	}
+	if p.VlanId != pair.VlanId {
+		return fmt.Errorf("pool %s (vlan %s) and its pair %s (vlan %s) are not on the same vlan", p.Name, p.VlanId, pair.Name, pair.VlanId)
+	}
+	return nil
+}
+
+// Capacity 地址池中可以分配的IP个数: range大小减去网关和排除的地址
+func (p *Pool) Capacity() *big.Int {
+	start, end := ipToInt(p.RangeStart), ipToInt(p.RangeEnd)
+	total := new(big.Int).Sub(end, start)
+	total.Add(total, big.NewInt(1))
+
+	// 排除的地址段先裁剪到range内，再合并重叠的部分
+	var excludes [][2]*big.Int
+	for _, e := range p.Exclude {
+		s, t := ipToInt(e.Start), ipToInt(e.End)
+		if s.Cmp(start) < 0 {
+			s = start
+		}
+		if t.Cmp(end) > 0 {
+			t = end
+		}
+		if s.Cmp(t) <= 0 {
+			excludes = append(excludes, [2]*big.Int{s, t})
+		}
+	}
+	sort.Slice(excludes, func(i, j int) bool { return excludes[i][0].Cmp(excludes[j][0]) < 0 })
+	var last *big.Int
+	for _, e := range excludes {
+		s, t := e[0], e[1]
+		if last != nil && s.Cmp(last) <= 0 {
+			s = new(big.Int).Add(last, big.NewInt(1))
+		}
+		if s.Cmp(t) <= 0 {
+			total.Sub(total, new(big.Int).Add(new(big.Int).Sub(t, s), big.NewInt(1)))
+		}
+		if last == nil || t.Cmp(last) > 0 {
+			last = t
+		}
+	}
+
+	if p.Gateway != nil && p.Contains(p.Gateway) && !p.Excluded(p.Gateway) {
+		total.Sub(total, big.NewInt(1))
+	}
+	return total
+}
+
+// MatchNode 节点label是否满足地址池的NodeSelector
+func (p *Pool) MatchNode(labels map[string]string) bool {
+	for k, v := range p.NodeSelector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Pool) String() string {
+	return fmt.Sprintf("%s(%s %s)", p.Name, p.IPNet().String(), p.Range.String())
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+func ipToInt(addr net.IP) *big.Int {
+	return new(big.Int).SetBytes(canonicalIP(addr))
+}
+
+// canonicalIP IPv4统一成4字节，IPv6统一成16字节
+func canonicalIP(addr net.IP) net.IP {
+	if v4 := addr.To4(); v4 != nil {
+		return v4
+	}
+	return addr.To16()
+}
@@ -0,0 +1,101 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPPool 一个app_net地址池，名字就是app_net注解里写的名字
+type IPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPPoolSpec   `json:"spec"`
+	Status IPPoolStatus `json:"status,omitempty"`
+}
+
+type IPPoolSpec struct {
+	// CIDR 地址池网段，例如 10.1.0.0/24 或 fd00:10::/120
+	CIDR string `json:"cidr"`
+	// Gateway 不填时使用网段的第一个地址
+	Gateway string `json:"gateway,omitempty"`
+	// VLAN 地址池所在的VLANNetwork的名字
+	VLAN string `json:"vlan"`
+	// Ranges 可以分配的地址段，不填时整个网段都可以分配
+	Ranges []IPRange `json:"ranges,omitempty"`
+	// Excludes 不参与分配的地址段
+	Excludes []IPRange `json:"excludes,omitempty"`
+	// NodeSelector 只有label匹配的节点才使用这个地址池，不填时所有节点都可以用
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Pair 双栈时配对的另一个地址族的IPPool名字，两个地址池必须在同一个VLAN
+	Pair string `json:"pair,omitempty"`
+	// MacPrefix macMode为ip时pod MAC的前缀(例如自己的OUI)，后面接IP的低位字节
+	MacPrefix string `json:"macPrefix,omitempty"`
+}
+
+// IPPoolStatus ts-cni-controller写入的同步结果和使用情况
+type IPPoolStatus struct {
+	// Synced 地址池是否已经同步到etcd，没有同步的地址池不能分配IP
+	Synced bool `json:"synced"`
+	// Message 没有同步的原因，例如网段和其他地址池重叠，或者IPPool正在删除但还有IP没有释放
+	Message string `json:"message,omitempty"`
+	// Total 可以分配的IP总数，不包括网关和excludes
+	Total int64 `json:"total"`
+	// Allocated 正在被pod使用的IP个数
+	Allocated int64 `json:"allocated"`
+	// Reserved 保留给StatefulSet、当前没有pod使用的IP个数
+	Reserved int64 `json:"reserved"`
+	// Free 还可以分配的IP个数
+	Free int64 `json:"free"`
+}
+
+// IPRange 地址段，End为空时只有Start一个地址
+type IPRange struct {
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type IPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []IPPool `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// VLANNetwork 节点上的一个VLAN，macvlan建在 <master>.<vlanId> 子接口上
+type VLANNetwork struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec VLANNetworkSpec `json:"spec"`
+}
+
+type VLANNetworkSpec struct {
+	// Master 物理网卡，不填时使用NetConf中的master
+	Master string `json:"master,omitempty"`
+	// VlanID 802.1Q VLAN ID, [1, 4094]
+	VlanID int `json:"vlanId"`
+	// MTU VLAN子接口的MTU，不填时使用master的MTU
+	MTU int `json:"mtu,omitempty"`
+	// Mode macvlan或ipvlan(按NetConf中的linkType)的模式，不填时使用NetConf中的mode
+	Mode string `json:"mode,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type VLANNetworkList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []VLANNetwork `json:"items"`
+}
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Allocation 每条IP分配记录的内容，DEL时按ContainerID+IfName释放
+type Allocation struct {
+	ContainerID  string    `json:"containerID"`
+	IfName       string    `json:"ifName"`
+	PodNamespace string    `json:"podNamespace,omitempty"`
+	PodName      string    `json:"podName,omitempty"`
+	Node         string    `json:"node,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	// Sticky 不为空时pod删除后记录保留，同一个key的pod重建时拿回同一个IP
+	// StatefulSet的pod是 <namespace>/<statefulset>/<ordinal>
+	Sticky string `json:"sticky,omitempty"`
+	// Conflict 不为空时是DAD发现已经被网络里其他主机占用的IP，内容是冲突的说明
+	// 记录不属于任何容器，IP不会再分配出去，GC过了保留时间或者运维删掉记录后才能再用
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// legacyLineBreak 老版本的分配记录是 containerID\r\nifName
+const legacyLineBreak = "\r\n"
+
+// Marshal 转成存储里保存的json
+func (a *Allocation) Marshal() string {
+	data, _ := json.Marshal(a)
+	return string(data)
+}
+
+// Owns 判断这条记录是不是这个容器网卡的
+func (a *Allocation) Owns(id string, ifname string) bool {
+	return a.ContainerID == strings.TrimSpace(id) && a.IfName == ifname
+}
+
+// Retained 容器删除后是否保留这条记录
+func (a *Allocation) Retained() bool {
+	return a.Sticky != ""
+}
+
+// Detach 容器删除后保留的记录，去掉容器信息，只留下Sticky
+func (a *Allocation) Detach() *Allocation {
+	return &Allocation{
+		PodNamespace: a.PodNamespace,
+		PodName:      a.PodName,
+		Timestamp:    time.Now(),
+		Sticky:       a.Sticky,
+	}
+}
+
+// MarkConflict 发现IP冲突后保留的记录，去掉容器信息，pod和节点留着方便排查
+func (a *Allocation) MarkConflict(reason string) *Allocation {
+	return &Allocation{
+		PodNamespace: a.PodNamespace,
+		PodName:      a.PodName,
+		Node:         a.Node,
+		Timestamp:    time.Now(),
+		Conflict:     reason,
+	}
+}
+
+// StickyKey StatefulSet的pod的Sticky
+func StickyKey(namespace string, statefulSet string, ordinal int) string {
+	return fmt.Sprintf("%s/%s/%d", namespace, statefulSet, ordinal)
+}
+
+// ParseStickyKey 把Sticky拆成namespace、StatefulSet名字和序号
+func ParseStickyKey(key string) (string, string, int, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return "", "", 0, fmt.Errorf("invalid sticky key %q", key)
+	}
+	ordinal, err := strconv.Atoi(parts[2])
+	if err != nil || ordinal < 0 {
+		return "", "", 0, fmt.Errorf("invalid ordinal in sticky key %q", key)
+	}
+	return parts[0], parts[1], ordinal, nil
+}
+
+// ParseAllocation 解析存储里的分配记录，兼容老版本的 containerID\r\nifName 格式
+// 解析不出来的返回nil
+func ParseAllocation(value string) *Allocation {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "{") {
+		a := &Allocation{}
+		if err := json.Unmarshal([]byte(value), a); err != nil {
+			return nil
+		}
+		return a
+	}
+	parts := strings.SplitN(value, legacyLineBreak, 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	return &Allocation{ContainerID: parts[0], IfName: parts[1]}
+}
@@ -0,0 +1,13 @@
+package crd_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCrd(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ts-cni/cni/backend/crd")
+}
@@ -0,0 +1,210 @@
+package crd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"ts-cni/cni/allocator"
+	tscniv1 "ts-cni/cni/apis/v1"
+	"ts-cni/cni/backend"
+	"ts-cni/cni/client"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ip"
+	hostlocal "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Store 地址池来自IPPool和VLANNetwork自定义资源，IP分配记录还是保存在下层的存储中
+type Store struct {
+	backend.Store
+	client client.Interface
+	// ipPools/vlans StartInformers之后的informer缓存，为空时每次请求apiserver
+	ipPools cache.Store
+	vlans   cache.Store
+}
+
+// Store implements the Store interface
+var _ backend.Store = &Store{}
+
+func New(store backend.Store, c client.Interface) *Store {
+	return &Store{Store: store, client: c}
+}
+
+// StartInformers 启动IPPool和VLANNetwork的informer，等缓存同步后返回，之后Pools只读缓存
+// ts-cni-daemon常驻时使用，tc-cni每次调用都是新进程，不启动informer
+func (s *Store) StartInformers(resync time.Duration, stopCh <-chan struct{}) error {
+	ipPools, poolInformer := cache.NewInformer(&cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return s.client.IPPools().List(context.TODO(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return s.client.IPPools().Watch(context.TODO(), opts)
+		},
+	}, &tscniv1.IPPool{}, resync, cache.ResourceEventHandlerFuncs{})
+	vlans, vlanInformer := cache.NewInformer(&cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return s.client.VLANNetworks().List(context.TODO(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return s.client.VLANNetworks().Watch(context.TODO(), opts)
+		},
+	}, &tscniv1.VLANNetwork{}, resync, cache.ResourceEventHandlerFuncs{})
+	go poolInformer.Run(stopCh)
+	go vlanInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, poolInformer.HasSynced, vlanInformer.HasSynced) {
+		return fmt.Errorf("failed to sync ippool and vlannetwork informers")
+	}
+	s.ipPools, s.vlans = ipPools, vlans
+	return nil
+}
+
+// Pools 列出所有IPPool，controller还没有同步(例如网段和其他地址池重叠)、
+// 找不到VLANNetwork或者配置有问题的地址池跳过
+func (s *Store) Pools() ([]*allocator.Pool, error) {
+	ipPools, vlans, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	var pools []*allocator.Pool
+	for _, ipPool := range ipPools {
+		// 重叠的地址池有各自的分配记录，不跳过会把同一个IP分给两个pod
+		if !ipPool.Status.Synced {
+			log.Printf("IPPool %s 还没有被controller同步: %s \n", ipPool.Name, ipPool.Status.Message)
+			continue
+		}
+		vlan, ok := vlans[ipPool.Spec.VLAN]
+		if !ok {
+			log.Printf("IPPool %s 的VLANNetwork %s 找不到 \n", ipPool.Name, ipPool.Spec.VLAN)
+			continue
+		}
+		pool, err := PoolFromCRD(ipPool, vlan)
+		if err != nil {
+			log.Println("IPAM 地址池配置有问题, err=", err)
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// list 启动了informer时读缓存，否则请求apiserver，IPPool按名字排序
+func (s *Store) list() ([]*tscniv1.IPPool, map[string]*tscniv1.VLANNetwork, error) {
+	var ipPools []*tscniv1.IPPool
+	vlans := make(map[string]*tscniv1.VLANNetwork)
+	if s.ipPools != nil {
+		for _, obj := range s.vlans.List() {
+			vlan := obj.(*tscniv1.VLANNetwork)
+			vlans[vlan.Name] = vlan
+		}
+		for _, obj := range s.ipPools.List() {
+			ipPools = append(ipPools, obj.(*tscniv1.IPPool))
+		}
+		sort.Slice(ipPools, func(i, j int) bool { return ipPools[i].Name < ipPools[j].Name })
+		return ipPools, vlans, nil
+	}
+
+	vlanList, err := s.client.VLANNetworks().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list vlannetworks: %v", err)
+	}
+	for i := range vlanList.Items {
+		vlans[vlanList.Items[i].Name] = &vlanList.Items[i]
+	}
+	poolList, err := s.client.IPPools().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list ippools: %v", err)
+	}
+	for i := range poolList.Items {
+		ipPools = append(ipPools, &poolList.Items[i])
+	}
+	return ipPools, vlans, nil
+}
+
+// PoolFromCRD 把IPPool和它的VLANNetwork转成allocator.Pool
+// 多个ranges转成从第一个range开始到最后一个range结束的一段，中间的空隙放到Exclude里
+func PoolFromCRD(ipPool *tscniv1.IPPool, vlan *tscniv1.VLANNetwork) (*allocator.Pool, error) {
+	_, subnet, err := net.ParseCIDR(ipPool.Spec.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q of IPPool %s: %v", ipPool.Spec.CIDR, ipPool.Name, err)
+	}
+	pool := &allocator.Pool{
+		Range: hostlocal.Range{
+			Subnet: types.IPNet(*subnet),
+		},
+		Name:         ipPool.Name,
+		Pair:         ipPool.Spec.Pair,
+		NodeSelector: ipPool.Spec.NodeSelector,
+		MacPrefix:    ipPool.Spec.MacPrefix,
+	}
+	if ipPool.Spec.Gateway != "" {
+		if pool.Gateway = net.ParseIP(ipPool.Spec.Gateway); pool.Gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %q of IPPool %s", ipPool.Spec.Gateway, ipPool.Name)
+		}
+	}
+	if vlan != nil {
+		pool.VlanId = strconv.Itoa(vlan.Spec.VlanID)
+		pool.Master = vlan.Spec.Master
+		pool.MTU = vlan.Spec.MTU
+		pool.Mode = vlan.Spec.Mode
+	}
+
+	ranges, err := parseRanges(ipPool.Spec.Ranges)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ranges of IPPool %s: %v", ipPool.Name, err)
+	}
+	if len(ranges) > 0 {
+		sort.Slice(ranges, func(i, j int) bool { return ip.Cmp(ranges[i].Start, ranges[j].Start) < 0 })
+		pool.RangeStart = ranges[0].Start
+		pool.RangeEnd = ranges[len(ranges)-1].End
+		for i := 1; i < len(ranges); i++ {
+			prevEnd, start := ranges[i-1].End, ranges[i].Start
+			if ip.Cmp(start, prevEnd) <= 0 {
+				return nil, fmt.Errorf("ranges of IPPool %s overlap at %s", ipPool.Name, start)
+			}
+			if gapStart, gapEnd := ip.NextIP(prevEnd), ip.PrevIP(start); ip.Cmp(gapStart, gapEnd) <= 0 {
+				pool.Exclude = append(pool.Exclude, allocator.ExcludeRange{Start: gapStart, End: gapEnd})
+			}
+		}
+	}
+
+	excludes, err := parseRanges(ipPool.Spec.Excludes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid excludes of IPPool %s: %v", ipPool.Name, err)
+	}
+	pool.Exclude = append(pool.Exclude, excludes...)
+
+	if err := pool.Canonicalize(); err != nil {
+		return nil, fmt.Errorf("invalid IPPool %s: %v", ipPool.Name, err)
+	}
+	return pool, nil
+}
+
+func parseRanges(ranges []tscniv1.IPRange) ([]allocator.ExcludeRange, error) {
+	var res []allocator.ExcludeRange
+	for _, r := range ranges {
+		start := net.ParseIP(r.Start)
+		if start == nil {
+			return nil, fmt.Errorf("invalid start %q", r.Start)
+		}
+		end := start
+		if r.End != "" {
+			if end = net.ParseIP(r.End); end == nil {
+				return nil, fmt.Errorf("invalid end %q", r.End)
+			}
+		}
+		if ip.Cmp(start, end) > 0 {
+			return nil, fmt.Errorf("start %s is after end %s", start, end)
+		}
+		res = append(res, allocator.ExcludeRange{Start: start, End: end})
+	}
+	return res, nil
+}
@@ -0,0 +1,160 @@
+package crd_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	tscniv1 "ts-cni/cni/apis/v1"
+	"ts-cni/cni/backend/crd"
+	fakestore "ts-cni/cni/backend/testing"
+	"ts-cni/cni/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+var _ = Describe("PoolFromCRD", func() {
+	var vlan *tscniv1.VLANNetwork
+
+	BeforeEach(func() {
+		vlan = &tscniv1.VLANNetwork{
+			ObjectMeta: metav1.ObjectMeta{Name: "vlan100"},
+			Spec:       tscniv1.VLANNetworkSpec{Master: "eth1", VlanID: 100, MTU: 1400, Mode: "private"},
+		}
+	})
+
+	newIPPool := func(spec tscniv1.IPPoolSpec) *tscniv1.IPPool {
+		return &tscniv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "web"}, Spec: spec}
+	}
+
+	It("should take the VLAN settings from the VLANNetwork", func() {
+		pool, err := crd.PoolFromCRD(newIPPool(tscniv1.IPPoolSpec{CIDR: "10.1.0.0/24", Gateway: "10.1.0.254", VLAN: "vlan100"}), vlan)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.Name).To(Equal("web"))
+		Expect(pool.VlanId).To(Equal("100"))
+		Expect(pool.Master).To(Equal("eth1"))
+		Expect(pool.MTU).To(Equal(1400))
+		Expect(pool.Mode).To(Equal("private"))
+		Expect(pool.Gateway.String()).To(Equal("10.1.0.254"))
+		Expect(pool.RangeStart.String()).To(Equal("10.1.0.1"))
+		Expect(pool.RangeEnd.String()).To(Equal("10.1.0.254"))
+	})
+
+	It("should turn gaps between ranges into excludes", func() {
+		pool, err := crd.PoolFromCRD(newIPPool(tscniv1.IPPoolSpec{
+			CIDR: "10.1.0.0/24",
+			VLAN: "vlan100",
+			Ranges: []tscniv1.IPRange{
+				{Start: "10.1.0.100", End: "10.1.0.120"},
+				{Start: "10.1.0.10", End: "10.1.0.20"},
+			},
+			Excludes: []tscniv1.IPRange{{Start: "10.1.0.15"}},
+		}), vlan)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.RangeStart.String()).To(Equal("10.1.0.10"))
+		Expect(pool.RangeEnd.String()).To(Equal("10.1.0.120"))
+		Expect(pool.Allocatable(net.ParseIP("10.1.0.20"))).To(BeTrue())
+		Expect(pool.Allocatable(net.ParseIP("10.1.0.21"))).To(BeFalse())
+		Expect(pool.Allocatable(net.ParseIP("10.1.0.99"))).To(BeFalse())
+		Expect(pool.Allocatable(net.ParseIP("10.1.0.100"))).To(BeTrue())
+		Expect(pool.Allocatable(net.ParseIP("10.1.0.15"))).To(BeFalse())
+	})
+
+	It("should reject overlapping ranges and bad CIDRs", func() {
+		_, err := crd.PoolFromCRD(newIPPool(tscniv1.IPPoolSpec{
+			CIDR: "10.1.0.0/24",
+			VLAN: "vlan100",
+			Ranges: []tscniv1.IPRange{
+				{Start: "10.1.0.10", End: "10.1.0.20"},
+				{Start: "10.1.0.20", End: "10.1.0.30"},
+			},
+		}), vlan)
+		Expect(err).To(MatchError(ContainSubstring("overlap")))
+
+		_, err = crd.PoolFromCRD(newIPPool(tscniv1.IPPoolSpec{CIDR: "10.1.0.0/33", VLAN: "vlan100"}), vlan)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Store", func() {
+	var (
+		server *httptest.Server
+		lists  int32
+	)
+
+	BeforeEach(func() {
+		vlans := &tscniv1.VLANNetworkList{Items: []tscniv1.VLANNetwork{{
+			ObjectMeta: metav1.ObjectMeta{Name: "vlan100"},
+			Spec:       tscniv1.VLANNetworkSpec{VlanID: 100},
+		}}}
+		pools := &tscniv1.IPPoolList{Items: []tscniv1.IPPool{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web"},
+				Spec:       tscniv1.IPPoolSpec{CIDR: "10.1.0.0/24", VLAN: "vlan100"},
+				Status:     tscniv1.IPPoolStatus{Synced: true},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-overlap"},
+				Spec:       tscniv1.IPPoolSpec{CIDR: "10.1.0.0/25", VLAN: "vlan100"},
+				Status:     tscniv1.IPPoolStatus{Message: "cidr 10.1.0.0/25 overlaps with pool web (10.1.0.0/24)"},
+			},
+		}}
+		mux := http.NewServeMux()
+		lists = 0
+		serve := func(obj interface{}) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("watch") == "true" {
+					// 没有变化，watch一直挂着直到informer停止
+					<-r.Context().Done()
+					return
+				}
+				atomic.AddInt32(&lists, 1)
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(obj)
+			}
+		}
+		mux.HandleFunc("/apis/ts-cni.io/v1/vlannetworks", serve(vlans))
+		mux.HandleFunc("/apis/ts-cni.io/v1/ippools", serve(pools))
+		server = httptest.NewServer(mux)
+	})
+
+	AfterEach(func() {
+		// informer的watch连接不会自己断开
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	It("should skip pools the controller has not synced", func() {
+		c, err := client.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		pools, err := crd.New(fakestore.NewFakeStore(nil), c).Pools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools).To(HaveLen(1))
+		Expect(pools[0].Name).To(Equal("web"))
+	})
+
+	It("should serve pools from the informer cache once started", func() {
+		c, err := client.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		store := crd.New(fakestore.NewFakeStore(nil), c)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		Expect(store.StartInformers(time.Hour, stopCh)).To(Succeed())
+		listed := atomic.LoadInt32(&lists)
+
+		for i := 0; i < 3; i++ {
+			pools, err := store.Pools()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pools).To(HaveLen(1))
+			Expect(pools[0].Name).To(Equal("web"))
+			Expect(pools[0].VlanId).To(Equal("100"))
+		}
+		Expect(atomic.LoadInt32(&lists)).To(Equal(listed))
+	})
+})
@@ -0,0 +1,241 @@
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+)
+
+var defaultDataDir = "/var/lib/cni/ts-cni/networks"
+
+// Store 单节点使用的磁盘存储，每个地址池一个目录，每个IP一个文件，
+// 文件内容是backend.Allocation的json
+type Store struct {
+	*FileLock
+	dataDir string
+	pools   []*allocator.Pool
+}
+
+// Store implements the Store interface
+var _ backend.Store = &Store{}
+
+// New 地址池来自NetConf中的配置
+func New(dataDir string, pools []*allocator.Pool) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, p := range pools {
+		if p.Name == "" || strings.ContainsAny(p.Name, "/\\") {
+			return nil, fmt.Errorf("invalid pool name %q", p.Name)
+		}
+		if err := os.MkdirAll(filepath.Join(dataDir, p.Name), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	lk, err := NewFileLock(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{lk, dataDir, pools}, nil
+}
+
+func (s *Store) Pools() ([]*allocator.Pool, error) {
+	return s.pools, nil
+}
+
+func (s *Store) Reserved(pool string) ([]net.IP, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dataDir, pool))
+	if os.IsNotExist(err) {
+		// 地址池来自自定义资源时目录在第一次分配时才创建
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, f := range files {
+		if ip := net.ParseIP(f.Name()); ip != nil && !f.IsDir() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) Reserve(alloc *backend.Allocation, ip net.IP, pool string) (bool, error) {
+	if err := os.MkdirAll(filepath.Join(s.dataDir, pool), 0755); err != nil {
+		return false, err
+	}
+	fname := filepath.Join(s.dataDir, pool, ip.String())
+
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.WriteString(alloc.Marshal()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// Release 调用方需要持有文件锁，文件内容和读出来时不一样就不删除
+func (s *Store) Release(r *backend.Record) (bool, error) {
+	fname, unchanged, err := s.unchanged(r)
+	if err != nil || !unchanged {
+		return false, err
+	}
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// Update 调用方需要持有文件锁，文件内容和读出来时不一样就不改
+func (s *Store) Update(r *backend.Record, alloc *backend.Allocation) (bool, error) {
+	fname, unchanged, err := s.unchanged(r)
+	if err != nil || !unchanged {
+		return false, err
+	}
+	if err := ioutil.WriteFile(fname, []byte(alloc.Marshal()), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unchanged 记录文件的内容是不是还和r一样
+func (s *Store) unchanged(r *backend.Record) (string, bool, error) {
+	fname := filepath.Join(s.dataDir, r.Pool, r.IP.String())
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return fname, false, nil
+	}
+	if err != nil {
+		return fname, false, err
+	}
+	a := backend.ParseAllocation(string(data))
+	return fname, a != nil && a.Marshal() == r.Allocation.Marshal(), nil
+}
+
+// N.B. This function eats errors to be tolerant and
+// release as much as possible
+func (s *Store) ReleaseByID(id string, ifname string) error {
+	return filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		if a := backend.ParseAllocation(string(data)); a != nil && a.Owns(id, ifname) {
+			if a.Retained() {
+				_ = ioutil.WriteFile(path, []byte(a.Detach().Marshal()), 0644)
+			} else {
+				_ = os.Remove(path)
+			}
+		}
+		return nil
+	})
+}
+
+// GetByID returns the IPs which have been allocated to the specific ID
+func (s *Store) GetByID(id string, ifname string) ([]net.IP, error) {
+	var ips []net.IP
+
+	// walk through all ips in all pools to get the ones which belong to a specific ID
+	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// 读目录和读文件之间被释放了
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if a := backend.ParseAllocation(string(data)); a != nil && a.Owns(id, ifname) {
+			_, ipString := filepath.Split(path)
+			if ip := net.ParseIP(ipString); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+func (s *Store) Records() ([]*backend.Record, error) {
+	dirs, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var records []*backend.Record
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dataDir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			ip := net.ParseIP(f.Name())
+			if ip == nil || f.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(s.dataDir, d.Name(), f.Name()))
+			if err != nil {
+				continue
+			}
+			if a := backend.ParseAllocation(string(data)); a != nil {
+				records = append(records, &backend.Record{Pool: d.Name(), IP: ip, Allocation: a})
+			}
+		}
+	}
+	return records, nil
+}
+
+// Rebind 调用方需要持有文件锁
+func (s *Store) Rebind(alloc *backend.Allocation, ip net.IP, pool string) (bool, error) {
+	fname := filepath.Join(s.dataDir, pool, ip.String())
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if a := backend.ParseAllocation(string(data)); a == nil || a.Sticky != alloc.Sticky {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(fname, []byte(alloc.Marshal()), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
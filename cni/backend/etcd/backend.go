@@ -0,0 +1,207 @@
+package etcd
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+)
+
+// RootDir 地址池和IP分配记录在etcd中的根目录
+// /ipam/<pool>       地址池配置
+// /ipam/<pool>/<ip>  IP分配记录
+const RootDir = "/ipam"
+
+// Store 多节点共享的etcd存储
+type Store struct {
+	client *utils.EtcdClient
+}
+
+// Store implements the Store interface
+var _ backend.Store = &Store{}
+
+func New(conf *structs.EtcdConf) (*Store, error) {
+	client, err := utils.NewEtcdClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{client: client}, nil
+}
+
+// NewWithClient 使用已有的etcd连接，Close时会断开这个连接
+func NewWithClient(client *utils.EtcdClient) *Store {
+	return &Store{client: client}
+}
+
+// Lock 每个IP的占用和释放都是etcd事务，不需要全局锁
+func (s *Store) Lock() error {
+	return nil
+}
+
+func (s *Store) Unlock() error {
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.client.EtcdDisconnect()
+	return nil
+}
+
+func (s *Store) Pools() ([]*allocator.Pool, error) {
+	kvs, err := s.client.EtcdGetPrefix(RootDir + "/")
+	if err != nil {
+		return nil, err
+	}
+	var pools []*allocator.Pool
+	for _, kv := range kvs {
+		name := strings.TrimPrefix(kv.K, RootDir+"/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		pool, err := allocator.LoadPool(name, kv.V)
+		if err != nil {
+			log.Println("IPAM 地址池配置有问题, err=", err)
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func (s *Store) Reserved(pool string) ([]net.IP, error) {
+	kvs, err := s.client.EtcdGetPrefix(poolDir(pool))
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, kv := range kvs {
+		if ip := net.ParseIP(strings.TrimPrefix(kv.K, poolDir(pool))); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) Reserve(alloc *backend.Allocation, ip net.IP, pool string) (bool, error) {
+	return s.client.EtcdReserve(ipKey(pool, ip), alloc.Marshal())
+}
+
+// Release 按读出来时的版本删除，期间被改过的记录不会被误删
+func (s *Store) Release(r *backend.Record) (bool, error) {
+	return s.client.EtcdDeleteIf(ipKey(r.Pool, r.IP), r.Revision)
+}
+
+func (s *Store) Update(r *backend.Record, alloc *backend.Allocation) (bool, error) {
+	return s.client.EtcdPutIf(ipKey(r.Pool, r.IP), alloc.Marshal(), r.Revision)
+}
+
+// ReleaseByID 删除这个容器的所有分配记录，Sticky的记录只去掉容器信息
+// 只改读出来时的那个版本，期间被释放又被别人占用的IP不会被误删
+func (s *Store) ReleaseByID(id string, ifname string) error {
+	kvs, err := s.byID(id, ifname)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		var done bool
+		if a := backend.ParseAllocation(kv.V); a.Retained() {
+			done, err = s.client.EtcdPutIf(kv.K, a.Detach().Marshal(), kv.ModRevision)
+		} else {
+			done, err = s.client.EtcdDeleteIf(kv.K, kv.ModRevision)
+		}
+		if err != nil {
+			return err
+		}
+		if !done {
+			log.Println("IPAM 分配记录已经变了, 不删除:", kv.K)
+		}
+	}
+	return nil
+}
+
+// GetByID returns the IPs which have been allocated to the specific ID
+func (s *Store) GetByID(id string, ifname string) ([]net.IP, error) {
+	kvs, err := s.byID(id, ifname)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, kv := range kvs {
+		if ip := net.ParseIP(kv.K[strings.LastIndex(kv.K, "/")+1:]); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) Records() ([]*backend.Record, error) {
+	kvs, err := s.allocations()
+	if err != nil {
+		return nil, err
+	}
+	var records []*backend.Record
+	for _, kv := range kvs {
+		parts := strings.Split(strings.TrimPrefix(kv.K, RootDir+"/"), "/")
+		ip := net.ParseIP(parts[1])
+		a := backend.ParseAllocation(kv.V)
+		if ip == nil || a == nil {
+			continue
+		}
+		records = append(records, &backend.Record{Pool: parts[0], IP: ip, Allocation: a, Revision: kv.ModRevision})
+	}
+	return records, nil
+}
+
+// Rebind 读出记录确认Sticky没变，再按读出来的版本更新
+func (s *Store) Rebind(alloc *backend.Allocation, ip net.IP, pool string) (bool, error) {
+	kv, err := s.client.EtcdGetKey(ipKey(pool, ip))
+	if err != nil || kv == nil {
+		return false, err
+	}
+	if a := backend.ParseAllocation(kv.V); a == nil || a.Sticky != alloc.Sticky {
+		return false, nil
+	}
+	return s.client.EtcdPutIf(kv.K, alloc.Marshal(), kv.ModRevision)
+}
+
+// byID 找出属于id+ifname的分配记录
+func (s *Store) byID(id string, ifname string) ([]utils.EtcdGetValue, error) {
+	kvs, err := s.allocations()
+	if err != nil {
+		return nil, err
+	}
+	var res []utils.EtcdGetValue
+	for _, kv := range kvs {
+		if a := backend.ParseAllocation(kv.V); a != nil && a.Owns(id, ifname) {
+			res = append(res, kv)
+		}
+	}
+	return res, nil
+}
+
+// allocations 所有的分配记录，只看 /ipam/<pool>/<ip> 这一层
+func (s *Store) allocations() ([]utils.EtcdGetValue, error) {
+	kvs, err := s.client.EtcdGetPrefix(RootDir + "/")
+	if err != nil {
+		return nil, err
+	}
+	var res []utils.EtcdGetValue
+	for _, kv := range kvs {
+		if strings.Count(strings.TrimPrefix(kv.K, RootDir+"/"), "/") == 1 {
+			res = append(res, kv)
+		}
+	}
+	return res, nil
+}
+
+func poolDir(pool string) string {
+	return RootDir + "/" + pool + "/"
+}
+
+func ipKey(pool string, ip net.IP) string {
+	return poolDir(pool) + ip.String()
+}
@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"net"
+
+	"ts-cni/cni/allocator"
+)
+
+// Store tc-cni的IPAM存储，接口和host-local的backend.Store保持一致，
+// 另外多了地址池的查询，因为tc-cni的地址池也放在存储里
+type Store interface {
+	Lock() error
+	Unlock() error
+	Close() error
+	// Pools 返回所有的地址池
+	Pools() ([]*allocator.Pool, error)
+	// Reserved 返回地址池中已经分配出去的IP
+	Reserved(pool string) ([]net.IP, error)
+	// Reserve 占用一个IP，并保存是哪个pod的哪个容器网卡用的
+	Reserve(alloc *Allocation, ip net.IP, pool string) (bool, error)
+	// Release 删除Records读出来的一条记录，记录在这之后被改过(例如被释放后又被别人占用、
+	// 被Rebind给了新的容器)时不删除并返回false
+	Release(r *Record) (bool, error)
+	// Update 把Records读出来的一条记录改成alloc，记录在这之后被改过时不改并返回false
+	Update(r *Record, alloc *Allocation) (bool, error)
+	ReleaseByID(id string, ifname string) error
+	// GetByID 返回分配给这个容器网卡的IP，存储出错时返回错误而不是空列表
+	GetByID(id string, ifname string) ([]net.IP, error)
+	// Records 返回所有地址池中的分配记录
+	Records() ([]*Record, error)
+	// Rebind 把保留的分配记录交给新的容器网卡，
+	// 只有存储中的记录和alloc的Sticky相同时才成功
+	Rebind(alloc *Allocation, ip net.IP, pool string) (bool, error)
+}
+
+// Record 存储中的一条IP分配记录
+type Record struct {
+	Pool       string
+	IP         net.IP
+	Allocation *Allocation
+	// Revision etcd中这条记录的ModRevision，Release时用来确认记录没有变过，其他存储为0
+	Revision int64
+}
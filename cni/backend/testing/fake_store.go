@@ -0,0 +1,133 @@
+package testing
+
+import (
+	"net"
+	"sync"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+)
+
+// FakeStore 内存存储，只在一个进程里有效，用于单元测试和不需要持久化的场景
+type FakeStore struct {
+	mu    sync.Mutex
+	pools []*allocator.Pool
+	// pool -> ip -> 分配记录
+	ipMap map[string]map[string]*backend.Allocation
+}
+
+// FakeStore implements the Store interface
+var _ backend.Store = &FakeStore{}
+
+func NewFakeStore(pools []*allocator.Pool) *FakeStore {
+	s := &FakeStore{
+		pools: pools,
+		ipMap: make(map[string]map[string]*backend.Allocation),
+	}
+	for _, p := range pools {
+		s.ipMap[p.Name] = make(map[string]*backend.Allocation)
+	}
+	return s
+}
+
+func (s *FakeStore) Lock() error {
+	s.mu.Lock()
+	return nil
+}
+
+func (s *FakeStore) Unlock() error {
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *FakeStore) Close() error {
+	return nil
+}
+
+func (s *FakeStore) Pools() ([]*allocator.Pool, error) {
+	return s.pools, nil
+}
+
+func (s *FakeStore) Reserved(pool string) ([]net.IP, error) {
+	var ips []net.IP
+	for k := range s.ipMap[pool] {
+		ips = append(ips, net.ParseIP(k))
+	}
+	return ips, nil
+}
+
+func (s *FakeStore) Reserve(alloc *backend.Allocation, ip net.IP, pool string) (bool, error) {
+	if s.ipMap[pool] == nil {
+		s.ipMap[pool] = make(map[string]*backend.Allocation)
+	}
+	key := ip.String()
+	if _, ok := s.ipMap[pool][key]; !ok {
+		s.ipMap[pool][key] = alloc
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *FakeStore) Release(r *backend.Record) (bool, error) {
+	v, ok := s.ipMap[r.Pool][r.IP.String()]
+	if !ok || v.Marshal() != r.Allocation.Marshal() {
+		return false, nil
+	}
+	delete(s.ipMap[r.Pool], r.IP.String())
+	return true, nil
+}
+
+func (s *FakeStore) Update(r *backend.Record, alloc *backend.Allocation) (bool, error) {
+	v, ok := s.ipMap[r.Pool][r.IP.String()]
+	if !ok || v.Marshal() != r.Allocation.Marshal() {
+		return false, nil
+	}
+	s.ipMap[r.Pool][r.IP.String()] = alloc
+	return true, nil
+}
+
+func (s *FakeStore) ReleaseByID(id string, ifname string) error {
+	for _, ips := range s.ipMap {
+		for k, v := range ips {
+			if v.Owns(id, ifname) {
+				if v.Retained() {
+					ips[k] = v.Detach()
+				} else {
+					delete(ips, k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FakeStore) GetByID(id string, ifname string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, pool := range s.ipMap {
+		for k, v := range pool {
+			if v.Owns(id, ifname) {
+				ips = append(ips, net.ParseIP(k))
+			}
+		}
+	}
+	return ips, nil
+}
+
+func (s *FakeStore) Records() ([]*backend.Record, error) {
+	var records []*backend.Record
+	for pool, ips := range s.ipMap {
+		for k, v := range ips {
+			records = append(records, &backend.Record{Pool: pool, IP: net.ParseIP(k), Allocation: v})
+		}
+	}
+	return records, nil
+}
+
+func (s *FakeStore) Rebind(alloc *backend.Allocation, ip net.IP, pool string) (bool, error) {
+	v, ok := s.ipMap[pool][ip.String()]
+	if !ok || v.Sticky != alloc.Sticky {
+		return false, nil
+	}
+	s.ipMap[pool][ip.String()] = alloc
+	return true, nil
+}
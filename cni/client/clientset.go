@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+
+	tscniv1 "ts-cni/cni/apis/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	// Scheme 只注册了tc-cni自定义资源的scheme
+	Scheme         = runtime.NewScheme()
+	Codecs         = serializer.NewCodecFactory(Scheme)
+	ParameterCodec = runtime.NewParameterCodec(Scheme)
+)
+
+func init() {
+	if err := tscniv1.AddToScheme(Scheme); err != nil {
+		panic(err)
+	}
+}
+
+// Interface IPPool和VLANNetwork的typed client，方便测试时替换
+type Interface interface {
+	IPPools() IPPoolInterface
+	VLANNetworks() VLANNetworkInterface
+}
+
+// Clientset ts-cni.io/v1 API组的客户端
+type Clientset struct {
+	restClient rest.Interface
+}
+
+// Clientset implements the Interface interface
+var _ Interface = &Clientset{}
+
+// NewForConfig 用k8s的连接配置创建ts-cni.io/v1的客户端
+func NewForConfig(c *rest.Config) (*Clientset, error) {
+	config := *c
+	config.GroupVersion = &tscniv1.SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = Codecs.WithoutConversion()
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	restClient, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s client: %v", tscniv1.SchemeGroupVersion, err)
+	}
+	return &Clientset{restClient: restClient}, nil
+}
+
+func (c *Clientset) IPPools() IPPoolInterface {
+	return &ipPools{client: c.restClient}
+}
+
+func (c *Clientset) VLANNetworks() VLANNetworkInterface {
+	return &vlanNetworks{client: c.restClient}
+}
+
+// RESTClient 返回底层的rest客户端
+func (c *Clientset) RESTClient() rest.Interface {
+	return c.restClient
+}
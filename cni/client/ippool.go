@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	tscniv1 "ts-cni/cni/apis/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+// IPPoolInterface IPPool是集群级别的资源，没有namespace
+type IPPoolInterface interface {
+	Create(ctx context.Context, ipPool *tscniv1.IPPool, opts metav1.CreateOptions) (*tscniv1.IPPool, error)
+	Update(ctx context.Context, ipPool *tscniv1.IPPool, opts metav1.UpdateOptions) (*tscniv1.IPPool, error)
+	UpdateStatus(ctx context.Context, ipPool *tscniv1.IPPool, opts metav1.UpdateOptions) (*tscniv1.IPPool, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*tscniv1.IPPool, error)
+	List(ctx context.Context, opts metav1.ListOptions) (*tscniv1.IPPoolList, error)
+	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+}
+
+type ipPools struct {
+	client rest.Interface
+}
+
+func (c *ipPools) Create(ctx context.Context, ipPool *tscniv1.IPPool, opts metav1.CreateOptions) (result *tscniv1.IPPool, err error) {
+	result = &tscniv1.IPPool{}
+	err = c.client.Post().
+		Resource("ippools").
+		VersionedParams(&opts, ParameterCodec).
+		Body(ipPool).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *ipPools) Update(ctx context.Context, ipPool *tscniv1.IPPool, opts metav1.UpdateOptions) (result *tscniv1.IPPool, err error) {
+	result = &tscniv1.IPPool{}
+	err = c.client.Put().
+		Resource("ippools").
+		Name(ipPool.Name).
+		VersionedParams(&opts, ParameterCodec).
+		Body(ipPool).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+// UpdateStatus 只更新status子资源
+func (c *ipPools) UpdateStatus(ctx context.Context, ipPool *tscniv1.IPPool, opts metav1.UpdateOptions) (result *tscniv1.IPPool, err error) {
+	result = &tscniv1.IPPool{}
+	err = c.client.Put().
+		Resource("ippools").
+		Name(ipPool.Name).
+		SubResource("status").
+		VersionedParams(&opts, ParameterCodec).
+		Body(ipPool).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *ipPools) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	return c.client.Delete().
+		Resource("ippools").
+		Name(name).
+		Body(&opts).
+		Do(ctx).
+		Error()
+}
+
+func (c *ipPools) Get(ctx context.Context, name string, opts metav1.GetOptions) (result *tscniv1.IPPool, err error) {
+	result = &tscniv1.IPPool{}
+	err = c.client.Get().
+		Resource("ippools").
+		Name(name).
+		VersionedParams(&opts, ParameterCodec).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *ipPools) List(ctx context.Context, opts metav1.ListOptions) (result *tscniv1.IPPoolList, err error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	result = &tscniv1.IPPoolList{}
+	err = c.client.Get().
+		Resource("ippools").
+		VersionedParams(&opts, ParameterCodec).
+		Timeout(timeout).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *ipPools) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	opts.Watch = true
+	return c.client.Get().
+		Resource("ippools").
+		VersionedParams(&opts, ParameterCodec).
+		Timeout(timeout).
+		Watch(ctx)
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	tscniv1 "ts-cni/cni/apis/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+// VLANNetworkInterface VLANNetwork是集群级别的资源，没有namespace
+type VLANNetworkInterface interface {
+	Create(ctx context.Context, vlanNetwork *tscniv1.VLANNetwork, opts metav1.CreateOptions) (*tscniv1.VLANNetwork, error)
+	Update(ctx context.Context, vlanNetwork *tscniv1.VLANNetwork, opts metav1.UpdateOptions) (*tscniv1.VLANNetwork, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*tscniv1.VLANNetwork, error)
+	List(ctx context.Context, opts metav1.ListOptions) (*tscniv1.VLANNetworkList, error)
+	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+}
+
+type vlanNetworks struct {
+	client rest.Interface
+}
+
+func (c *vlanNetworks) Create(ctx context.Context, vlanNetwork *tscniv1.VLANNetwork, opts metav1.CreateOptions) (result *tscniv1.VLANNetwork, err error) {
+	result = &tscniv1.VLANNetwork{}
+	err = c.client.Post().
+		Resource("vlannetworks").
+		VersionedParams(&opts, ParameterCodec).
+		Body(vlanNetwork).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *vlanNetworks) Update(ctx context.Context, vlanNetwork *tscniv1.VLANNetwork, opts metav1.UpdateOptions) (result *tscniv1.VLANNetwork, err error) {
+	result = &tscniv1.VLANNetwork{}
+	err = c.client.Put().
+		Resource("vlannetworks").
+		Name(vlanNetwork.Name).
+		VersionedParams(&opts, ParameterCodec).
+		Body(vlanNetwork).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *vlanNetworks) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	return c.client.Delete().
+		Resource("vlannetworks").
+		Name(name).
+		Body(&opts).
+		Do(ctx).
+		Error()
+}
+
+func (c *vlanNetworks) Get(ctx context.Context, name string, opts metav1.GetOptions) (result *tscniv1.VLANNetwork, err error) {
+	result = &tscniv1.VLANNetwork{}
+	err = c.client.Get().
+		Resource("vlannetworks").
+		Name(name).
+		VersionedParams(&opts, ParameterCodec).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *vlanNetworks) List(ctx context.Context, opts metav1.ListOptions) (result *tscniv1.VLANNetworkList, err error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	result = &tscniv1.VLANNetworkList{}
+	err = c.client.Get().
+		Resource("vlannetworks").
+		VersionedParams(&opts, ParameterCodec).
+		Timeout(timeout).
+		Do(ctx).
+		Into(result)
+	return
+}
+
+func (c *vlanNetworks) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	opts.Watch = true
+	return c.client.Get().
+		Resource("vlannetworks").
+		VersionedParams(&opts, ParameterCodec).
+		Timeout(timeout).
+		Watch(ctx)
+}
@@ -0,0 +1,108 @@
+package ipamd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"ts-cni/cni/structs"
+)
+
+// Client tc-cni通过unix socket调用ts-cni-daemon
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+var _ Interface = &Client{}
+
+func NewClient(socket string, timeout time.Duration) *Client {
+	return &Client{
+		socket: socket,
+		http: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Allocate(req *Request) (structs.NetInfo, error) {
+	return c.call("/allocate", req)
+}
+
+func (c *Client) Release(req *Request) error {
+	_, err := c.call("/release", req)
+	return err
+}
+
+func (c *Client) Check(req *Request) (structs.NetInfo, error) {
+	return c.call("/check", req)
+}
+
+func (c *Client) MarkConflict(req *Request) error {
+	_, err := c.call("/conflict", req)
+	return err
+}
+
+func (c *Client) Annotate(req *Request, info structs.NetInfo) error {
+	_, err := c.call("/annotate", &annotateRequest{Request: req, NetInfo: info})
+	return err
+}
+
+func (c *Client) ShimIPs(info structs.NetInfo) (structs.NetInfo, error) {
+	return c.call("/shim", info)
+}
+
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+func (c *Client) call(path string, body interface{}) (structs.NetInfo, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	// host随便写，连接由DialContext建到unix socket上
+	httpResp, err := c.http.Post("http://ipamd"+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return structs.NetInfo{}, fmt.Errorf("failed to call IPAM daemon %s: %v", c.socket, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(httpResp.Body)
+		return structs.NetInfo{}, fmt.Errorf("IPAM daemon %s returned %s: %s", path, httpResp.Status, bytes.TrimSpace(msg))
+	}
+	resp := &response{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return structs.NetInfo{}, fmt.Errorf("invalid response from IPAM daemon: %v", err)
+	}
+	if resp.Error != "" {
+		return resp.NetInfo, &remoteError{msg: resp.Error, err: reasons[resp.Reason]}
+	}
+	return resp.NetInfo, nil
+}
+
+// remoteError daemon返回的错误，Unwrap后是utils中对应的错误
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
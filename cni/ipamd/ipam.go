@@ -0,0 +1,301 @@
+package ipamd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// Request tc-cni一次ADD/CHECK/DEL需要的信息，本地调用和通过unix socket调用daemon都用它
+type Request struct {
+	ContainerID  string `json:"containerID"`
+	IfName       string `json:"ifName"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	// StickyIP StatefulSet的pod按名字+序号保留IP
+	StickyIP bool `json:"stickyIP,omitempty"`
+	// DefaultAppNet 集群默认的app_net
+	DefaultAppNet []string `json:"defaultAppNet,omitempty"`
+	// RequestedIPs runtimeConfig.ips或CNI_ARGS IP=指定的IP，为空时使用pod注解
+	RequestedIPs []string `json:"requestedIPs,omitempty"`
+	// PodIPs CHECK时prevResult中的IP，MarkConflict时是DAD发现冲突的IP
+	PodIPs []net.IP `json:"podIPs,omitempty"`
+	// Conflict MarkConflict时冲突的说明，例如占用IP的主机的MAC
+	Conflict string `json:"conflict,omitempty"`
+	// Mac ADD完成后pod网卡的MAC，写到pod注解上
+	Mac string `json:"mac,omitempty"`
+}
+
+// Interface tc-cni使用的IPAM操作
+type Interface interface {
+	// Allocate 按pod的app_net分配IP，失败时给pod发Event
+	Allocate(req *Request) (structs.NetInfo, error)
+	// Release 释放容器网卡的IP，StatefulSet还需要时继续保留
+	Release(req *Request) error
+	// Check 确认prevResult中的IP还分配给这个容器网卡
+	Check(req *Request) (structs.NetInfo, error)
+	// MarkConflict 把DAD发现冲突的req.PodIPs留在存储里不再分配，之后Release不会释放它们
+	MarkConflict(req *Request) error
+	// Annotate 把分配结果写到pod注解上
+	Annotate(req *Request, info structs.NetInfo) error
+	// ShimIPs 节点的shim在info各地址池中的地址，返回的NetInfo.IPs和info.IPs一一对应
+	ShimIPs(info structs.NetInfo) (structs.NetInfo, error)
+	Close() error
+}
+
+// IPAM 直接访问存储和apiserver的Interface实现
+// tc-cni没有配置daemon时每次调用新建一个，daemon常驻进程中只有一个
+type IPAM struct {
+	// mu daemon并发处理请求，disk存储的flock在同一个进程里不互斥，所有存储操作都要先拿这个锁
+	mu    sync.Mutex
+	store backend.Store
+	// k8s 只有DEL和CHECK时可以为空，此时StatefulSet保留的IP继续保留
+	k8s  *utils.K8s
+	node string
+}
+
+var _ Interface = &IPAM{}
+
+func NewIPAM(store backend.Store, k8s *utils.K8s, node string) *IPAM {
+	return &IPAM{store: store, k8s: k8s, node: node}
+}
+
+func (a *IPAM) Allocate(req *Request) (info structs.NetInfo, err error) {
+	if a.k8s == nil {
+		return info, fmt.Errorf("k8s client is required to allocate IP")
+	}
+	defer func() {
+		if err != nil {
+			a.recordFailure(req, err)
+		}
+	}()
+	// 根据pod、上层控制器、namespace的注解或集群默认值，查出app_net切片
+	log.Println("当前pod namespace =", req.PodNamespace)
+	log.Println("当前pod的名称 =", req.PodName)
+	netArr, source, err := a.k8s.ResolvePodNet(req.PodNamespace, req.PodName, req.DefaultAppNet)
+	if err != nil {
+		return info, err
+	}
+	log.Println("CNI NetArr的值=", netArr, "来源=", source)
+	// 地址池配置了nodeSelector时只使用和当前节点匹配的地址池
+	if netArr, err = a.nodeNetArr(netArr); err != nil {
+		return info, err
+	}
+	alloc := &backend.Allocation{
+		ContainerID:  req.ContainerID,
+		IfName:       req.IfName,
+		PodNamespace: req.PodNamespace,
+		PodName:      req.PodName,
+		Node:         a.node,
+		Timestamp:    time.Now(),
+	}
+	// StatefulSet的pod按名字+序号保留IP，重建时拿回同一个IP
+	if req.StickyIP {
+		if alloc.Sticky, err = a.k8s.GetStickyKey(req.PodNamespace, req.PodName); err != nil {
+			return info, err
+		}
+	}
+	requested, err := a.requestedIPs(req)
+	if err != nil {
+		return info, err
+	}
+	a.mu.Lock()
+	if len(requested) > 0 {
+		log.Println("CNI 指定的IP=", requested)
+		info, err = utils.IpamAddStatic(a.store, netArr, alloc, requested)
+	} else {
+		info, err = utils.IpamAdd(a.store, netArr, alloc)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return info, err
+	}
+	info.AppNetSource = source
+	log.Println("CNI IpInfo=", info)
+	return info, nil
+}
+
+// nodeNetArr 去掉nodeSelector和当前节点不匹配的地址池，节点label只在需要时查询
+func (a *IPAM) nodeNetArr(netArr []string) ([]string, error) {
+	a.mu.Lock()
+	pools, err := a.store.Pools()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	selectors := make(map[string]*allocator.Pool, len(pools))
+	for _, p := range pools {
+		if len(p.NodeSelector) > 0 {
+			selectors[p.Name] = p
+		}
+	}
+	if len(selectors) == 0 {
+		return netArr, nil
+	}
+	var labels map[string]string
+	var res []string
+	for _, v := range netArr {
+		if p, ok := selectors[v]; ok {
+			if labels == nil {
+				if labels, err = a.k8s.GetNodeLabels(a.node); err != nil {
+					return nil, err
+				}
+			}
+			if !p.MatchNode(labels) {
+				log.Printf("地址池 %s 的nodeSelector和节点 %s 不匹配 \n", v, a.node)
+				continue
+			}
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// requestedIPs pod指定的IP，优先级: runtimeConfig.ips/CNI_ARGS IP= > pod注解ts-cni/requested-ip
+func (a *IPAM) requestedIPs(req *Request) ([]net.IP, error) {
+	if len(req.RequestedIPs) > 0 {
+		return utils.ParseIPList(strings.Join(req.RequestedIPs, ","))
+	}
+	return a.k8s.GetRequestedIPs(req.PodNamespace, req.PodName)
+}
+
+// recordFailure 分配IP失败时给pod发Warning Event，kubectl describe pod可以看到原因
+func (a *IPAM) recordFailure(req *Request, allocErr error) {
+	reason := "IPAllocationFailed"
+	switch {
+	case errors.Is(allocErr, utils.ErrPoolNotFound):
+		reason = "AppNetNotFound"
+	case errors.Is(allocErr, utils.ErrPoolExhausted):
+		reason = "PoolExhausted"
+	case errors.Is(allocErr, utils.ErrIPUnavailable):
+		reason = "RequestedIPUnavailable"
+	}
+	if err := a.k8s.PodEvent(req.PodNamespace, req.PodName, coreV1.EventTypeWarning, reason, allocErr.Error()); err != nil {
+		log.Printf("发送pod Event失败: %v \n", err)
+	}
+}
+
+func (a *IPAM) Release(req *Request) error {
+	stickyKeys, err := a.release(req)
+	if err != nil {
+		return err
+	}
+	if len(stickyKeys) > 0 {
+		a.releaseSticky(stickyKeys)
+	}
+	return nil
+}
+
+// release 释放容器网卡的IP，返回其中StatefulSet保留的Sticky
+func (a *IPAM) release(req *Request) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var stickyKeys []string
+	var err error
+	if req.StickyIP {
+		if stickyKeys, err = utils.StickyKeys(a.store, req.ContainerID, req.IfName); err != nil {
+			return nil, err
+		}
+	}
+	if err := utils.IpamDel(a.store, req.ContainerID, req.IfName); err != nil {
+		return nil, err
+	}
+	return stickyKeys, nil
+}
+
+// releaseSticky StatefulSet缩容或被删除了才真正释放保留的IP
+// 查不到apiserver时继续保留，不影响DEL
+func (a *IPAM) releaseSticky(stickyKeys []string) {
+	if a.k8s == nil {
+		log.Println("IPAM 没有k8s连接, 继续保留IP=", stickyKeys)
+		return
+	}
+	for _, key := range stickyKeys {
+		retained, err := a.k8s.StickyRetained(key)
+		if err != nil {
+			log.Println("IPAM 查询StatefulSet失败, 继续保留IP, err=", err)
+			continue
+		}
+		if retained {
+			log.Println("IPAM 保留StatefulSet pod的IP=", key)
+			continue
+		}
+		a.mu.Lock()
+		err = utils.IpamReleaseSticky(a.store, key)
+		a.mu.Unlock()
+		if err != nil {
+			log.Println("IPAM 释放保留的IP失败, err=", err)
+		}
+	}
+}
+
+func (a *IPAM) Check(req *Request) (structs.NetInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return utils.IpamCheck(a.store, req.PodIPs, req.ContainerID, req.IfName)
+}
+
+func (a *IPAM) MarkConflict(req *Request) error {
+	a.mu.Lock()
+	err := utils.IpamConflict(a.store, req.ContainerID, req.IfName, req.PodIPs, req.Conflict)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// 冲突要运维去找占用IP的主机，给pod发Event提示
+	if a.k8s != nil {
+		if err := a.k8s.PodEvent(req.PodNamespace, req.PodName, coreV1.EventTypeWarning, "AddressConflict", req.Conflict); err != nil {
+			log.Printf("发送pod Event失败: %v \n", err)
+		}
+	}
+	return nil
+}
+
+// Annotate 把分配到的IP、VLAN、地址池、MAC和app_net的来源写到pod注解上
+func (a *IPAM) Annotate(req *Request, info structs.NetInfo) error {
+	if a.k8s == nil {
+		return fmt.Errorf("k8s client is required to annotate pod")
+	}
+	var ips, pools []string
+	for _, ipInfo := range info.IPs {
+		ips = append(ips, ipInfo.IPAddress.String())
+		pools = append(pools, ipInfo.AppNet)
+	}
+	return a.k8s.AnnotatePod(req.PodNamespace, req.PodName, map[string]string{
+		utils.IPAnnotation:          strings.Join(ips, ","),
+		utils.VlanAnnotation:        info.VlanId,
+		utils.PoolAnnotation:        strings.Join(pools, ","),
+		utils.MacAnnotation:         req.Mac,
+		utils.ContainerIDAnnotation: req.ContainerID,
+		// app_net的来源，方便排查pod为什么用了这个地址池
+		utils.AppNetSourceAnnotation: info.AppNetSource,
+	})
+}
+
+func (a *IPAM) ShimIPs(info structs.NetInfo) (structs.NetInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	shimIPs, err := utils.IpamShim(a.store, a.node, info)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	info.IPs = shimIPs
+	return info, nil
+}
+
+func (a *IPAM) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.store.Close()
+}
@@ -0,0 +1,13 @@
+package ipamd_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestIpamd(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ts-cni/cni/ipamd")
+}
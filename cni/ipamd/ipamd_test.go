@@ -0,0 +1,225 @@
+package ipamd_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend/disk"
+	fakestore "ts-cni/cni/backend/testing"
+	"ts-cni/cni/ipamd"
+	"ts-cni/cni/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("IPAM daemon", func() {
+	var (
+		tmpDir string
+		store  *fakestore.FakeStore
+		client *fake.Clientset
+		ipam   *ipamd.Client
+		stopCh chan struct{}
+		done   chan error
+	)
+
+	newRequest := func(pod string) *ipamd.Request {
+		return &ipamd.Request{ContainerID: "c-" + pod, IfName: "eth0", PodNamespace: "default", PodName: pod}
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "ipamd")
+		Expect(err).NotTo(HaveOccurred())
+
+		pool, err := allocator.LoadPool("web", `{"subnet":"10.1.0.0/30","vlan":"100"}`)
+		Expect(err).NotTo(HaveOccurred())
+		dbPool, err := allocator.LoadPool("db", `{"subnet":"10.2.0.0/29","vlan":"200"}`)
+		Expect(err).NotTo(HaveOccurred())
+		store = fakestore.NewFakeStore([]*allocator.Pool{pool, dbPool})
+		client = fake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "default"}},
+			&corev1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "web-1", Annotations: map[string]string{"app_net": "web"}}},
+			&corev1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "web-2", Annotations: map[string]string{"app_net": "web"}}},
+			&corev1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "lost", Annotations: map[string]string{"app_net": "missing"}}},
+			&corev1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "db-1", Annotations: map[string]string{"app_net": "db"}}},
+		)
+		k8s := utils.NewK8sForClients(client, nil, meta.NewDefaultRESTMapper(nil))
+
+		socket := filepath.Join(tmpDir, "ipamd.sock")
+		stopCh = make(chan struct{})
+		done = make(chan error, 1)
+		server := ipamd.NewServer(ipamd.NewIPAM(store, k8s, "node1"))
+		go func() {
+			done <- server.Serve(socket, stopCh)
+		}()
+		Eventually(func() error {
+			_, err := os.Stat(socket)
+			return err
+		}).Should(Succeed())
+		ipam = ipamd.NewClient(socket, 5*time.Second)
+	})
+
+	AfterEach(func() {
+		ipam.Close()
+		close(stopCh)
+		Eventually(done).Should(Receive(BeNil()))
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should allocate, check, annotate and release over the socket", func() {
+		req := newRequest("web-1")
+		info, err := ipam.Allocate(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.VlanId).To(Equal("100"))
+		Expect(info.AppNetSource).To(Equal("pod"))
+		Expect(info.IPs).To(HaveLen(1))
+		ip := info.IPs[0].IPAddress
+		Expect(ip.String()).To(Equal("10.1.0.2"))
+		Expect(info.IPs[0].Subnet.Mask).To(Equal(net.CIDRMask(30, 32)))
+
+		req.PodIPs = []net.IP{ip}
+		checked, err := ipam.Check(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checked.AppNet).To(Equal("web"))
+
+		req.Mac = "02:00:0a:01:00:02"
+		Expect(ipam.Annotate(req, info)).To(Succeed())
+		pod, err := client.CoreV1().Pods("default").Get(context.TODO(), "web-1", metaV1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations).To(HaveKeyWithValue("ts-cni/ip", "10.1.0.2"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("ts-cni/pool", "web"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("ts-cni/mac", "02:00:0a:01:00:02"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("ts-cni/app-net-source", "pod"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("ts-cni/container-id", req.ContainerID))
+
+		Expect(ipam.Release(req)).To(Succeed())
+		Expect(store.GetByID("c-web-1", "eth0")).To(BeEmpty())
+		_, err = ipam.Check(req)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should keep the error kind and record an event on failures", func() {
+		_, err := ipam.Allocate(newRequest("lost"))
+		Expect(errors.Is(err, utils.ErrPoolNotFound)).To(BeTrue())
+
+		_, err = ipam.Allocate(newRequest("web-1"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ipam.Allocate(newRequest("web-2"))
+		Expect(errors.Is(err, utils.ErrPoolExhausted)).To(BeTrue())
+
+		events, err := client.CoreV1().Events("default").List(context.TODO(), metaV1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		var reasons []string
+		for _, e := range events.Items {
+			reasons = append(reasons, e.Reason)
+		}
+		Expect(reasons).To(ConsistOf("AppNetNotFound", "PoolExhausted"))
+	})
+
+	It("should keep a conflicting IP out of the pool and allocate another one", func() {
+		req := newRequest("db-1")
+		info, err := ipam.Allocate(req)
+		Expect(err).NotTo(HaveOccurred())
+		conflicting := info.IPs[0].IPAddress
+
+		// tc-cni发现冲突后: 标记冲突、释放这次分配，再用同一个容器网卡重试
+		req.PodIPs = []net.IP{conflicting}
+		req.Conflict = "address already in use: " + conflicting.String() + " is used by 02:00:00:00:00:01"
+		Expect(ipam.MarkConflict(req)).To(Succeed())
+		Expect(ipam.Release(req)).To(Succeed())
+
+		retried, err := ipam.Allocate(newRequest("db-1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retried.IPs[0].IPAddress.Equal(conflicting)).To(BeFalse())
+
+		reserved, err := store.Reserved("db")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(ConsistOf(conflicting, retried.IPs[0].IPAddress))
+		records, err := store.Records()
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range records {
+			if r.IP.Equal(conflicting) {
+				Expect(r.Allocation.ContainerID).To(BeEmpty())
+				Expect(r.Allocation.Conflict).To(Equal(req.Conflict))
+				Expect(r.Allocation.PodName).To(Equal("db-1"))
+			}
+		}
+
+		events, err := client.CoreV1().Events("default").List(context.TODO(), metaV1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events.Items).To(HaveLen(1))
+		Expect(events.Items[0].Reason).To(Equal("AddressConflict"))
+	})
+
+	It("should honor requested IPs from the request", func() {
+		req := newRequest("web-2")
+		req.RequestedIPs = []string{"10.1.0.2"}
+		info, err := ipam.Allocate(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.IPs[0].IPAddress.String()).To(Equal("10.1.0.2"))
+	})
+})
+
+// slowStore 查重复分配时慢一点，放大并发请求之间的竞争
+type slowStore struct {
+	*disk.Store
+}
+
+func (s slowStore) GetByID(id string, ifname string) ([]net.IP, error) {
+	ips, err := s.Store.GetByID(id, ifname)
+	time.Sleep(20 * time.Millisecond)
+	return ips, err
+}
+
+var _ = Describe("IPAM with a disk store", func() {
+	It("should serialize concurrent requests inside the daemon", func() {
+		tmpDir, err := ioutil.TempDir("", "ipamd-disk")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		pool, err := allocator.LoadPool("web", `{"subnet":"10.1.0.0/26","vlan":"100"}`)
+		Expect(err).NotTo(HaveOccurred())
+		store, err := disk.New(tmpDir, []*allocator.Pool{pool})
+		Expect(err).NotTo(HaveOccurred())
+		client := fake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "default"}},
+			&corev1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "web-1", Annotations: map[string]string{"app_net": "web"}}},
+		)
+		ipam := ipamd.NewIPAM(slowStore{store}, utils.NewK8sForClients(client, nil, meta.NewDefaultRESTMapper(nil)), "node1")
+		defer ipam.Close()
+
+		// 同一个容器网卡重复的ADD，只能有一个成功
+		const n = 20
+		var wg sync.WaitGroup
+		var succeeded int32
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				req := &ipamd.Request{ContainerID: "c-web-1", IfName: "eth0", PodNamespace: "default", PodName: "web-1"}
+				if _, err := ipam.Allocate(req); err == nil {
+					atomic.AddInt32(&succeeded, 1)
+				} else {
+					Expect(err).To(MatchError(ContainSubstring("duplicate allocation")))
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(succeeded).To(Equal(int32(1)))
+		Expect(store.GetByID("c-web-1", "eth0")).To(HaveLen(1))
+	})
+})
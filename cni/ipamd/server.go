@@ -0,0 +1,154 @@
+package ipamd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+)
+
+// DefaultSocket 节点上ts-cni-daemon监听的unix socket
+const DefaultSocket = "/run/ts-cni/ipamd.sock"
+
+// 错误原因，client据此还原utils中的错误，tc-cni可以用errors.Is判断
+var reasons = map[string]error{
+	"PoolNotFound":  utils.ErrPoolNotFound,
+	"PoolExhausted": utils.ErrPoolExhausted,
+	"IPUnavailable": utils.ErrIPUnavailable,
+}
+
+// annotateRequest /annotate的请求体
+type annotateRequest struct {
+	Request *Request        `json:"request"`
+	NetInfo structs.NetInfo `json:"netInfo"`
+}
+
+// response 所有接口的响应体，Error不为空表示失败
+type response struct {
+	NetInfo structs.NetInfo `json:"netInfo"`
+	Error   string          `json:"error,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+}
+
+// Server 通过unix socket上的HTTP/JSON提供Interface，节点上所有tc-cni调用共用一个etcd连接和informer缓存
+type Server struct {
+	ipam Interface
+	mux  *http.ServeMux
+}
+
+func NewServer(ipam Interface) *Server {
+	s := &Server{ipam: ipam, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/allocate", s.handle(func(req *Request) (structs.NetInfo, error) {
+		return s.ipam.Allocate(req)
+	}))
+	s.mux.HandleFunc("/release", s.handle(func(req *Request) (structs.NetInfo, error) {
+		return structs.NetInfo{}, s.ipam.Release(req)
+	}))
+	s.mux.HandleFunc("/check", s.handle(func(req *Request) (structs.NetInfo, error) {
+		return s.ipam.Check(req)
+	}))
+	s.mux.HandleFunc("/conflict", s.handle(func(req *Request) (structs.NetInfo, error) {
+		return structs.NetInfo{}, s.ipam.MarkConflict(req)
+	}))
+	s.mux.HandleFunc("/annotate", s.annotate)
+	s.mux.HandleFunc("/shim", s.shim)
+	return s
+}
+
+// Serve 在socket上监听，stopCh关闭后退出
+func (s *Server) Serve(socket string, stopCh <-chan struct{}) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	// 上次退出时留下的socket文件
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socket, err)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	server := &http.Server{Handler: s.mux}
+	go func() {
+		<-stopCh
+		server.Shutdown(context.Background())
+	}()
+	log.Println("IPAM daemon 监听", socket)
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handle(fn func(req *Request) (structs.NetInfo, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &Request{}
+		if !decode(w, r, req) {
+			return
+		}
+		info, err := fn(req)
+		writeResponse(w, r, info, err)
+	}
+}
+
+func (s *Server) annotate(w http.ResponseWriter, r *http.Request) {
+	body := &annotateRequest{}
+	if !decode(w, r, body) {
+		return
+	}
+	if body.Request == nil {
+		http.Error(w, "request is required", http.StatusBadRequest)
+		return
+	}
+	writeResponse(w, r, structs.NetInfo{}, s.ipam.Annotate(body.Request, body.NetInfo))
+}
+
+func (s *Server) shim(w http.ResponseWriter, r *http.Request) {
+	info := structs.NetInfo{}
+	if !decode(w, r, &info) {
+		return
+	}
+	shimInfo, err := s.ipam.ShimIPs(info)
+	writeResponse(w, r, shimInfo, err)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, info structs.NetInfo, err error) {
+	resp := &response{NetInfo: info}
+	if err != nil {
+		log.Printf("IPAM daemon %s 失败: %v \n", r.URL.Path, err)
+		resp.Error = err.Error()
+		for reason, sentinel := range reasons {
+			if errors.Is(err, sentinel) {
+				resp.Reason = reason
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("IPAM daemon 写响应失败: %v \n", err)
+	}
+}
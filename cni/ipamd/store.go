@@ -0,0 +1,56 @@
+package ipamd
+
+import (
+	"fmt"
+
+	"ts-cni/cni/backend"
+	"ts-cni/cni/backend/crd"
+	"ts-cni/cni/backend/disk"
+	"ts-cni/cni/backend/etcd"
+	"ts-cni/cni/client"
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+)
+
+// NewStore 根据NetConf中的etcd、store和kubeconfig配置创建IPAM存储，默认使用etcd
+// tc-cni和ts-cni-daemon用同一份配置，两种模式的行为一样
+func NewStore(etcdConf *structs.EtcdConf, storeConf *structs.StoreConf, kubeconfig string) (backend.Store, error) {
+	for _, p := range storeConf.Pools {
+		if err := p.Canonicalize(); err != nil {
+			return nil, fmt.Errorf("invalid pool %q: %v", p.Name, err)
+		}
+	}
+	var store backend.Store
+	var err error
+	switch storeConf.Type {
+	case "", "etcd":
+		store, err = etcd.New(etcdConf)
+	case "disk":
+		store, err = disk.New(storeConf.DataDir, storeConf.Pools)
+	default:
+		return nil, fmt.Errorf("unknown store type: %q", storeConf.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch storeConf.PoolSource {
+	case "":
+		return store, nil
+	case "crd":
+		config, err := utils.LoadK8sConfig(kubeconfig)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		crdClient, err := client.NewForConfig(config)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		return crd.New(store, crdClient), nil
+	default:
+		store.Close()
+		return nil, fmt.Errorf("unknown pool source: %q", storeConf.PoolSource)
+	}
+}
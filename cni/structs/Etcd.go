@@ -0,0 +1,18 @@
+package structs
+
+// EtcdConf NetConf中etcd块的配置，用于连接存储IPAM信息的etcd集群
+type EtcdConf struct {
+	// etcd地址列表，例如 ["https://10.0.0.1:2379","https://10.0.0.2:2379"]
+	Endpoints []string `json:"endpoints"`
+	// TLS证书路径，只配CAFile时只校验服务端证书
+	CAFile   string `json:"caFile,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// etcd用户认证，Username/Password和TokenFile二选一
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// TokenFile 文件内容格式和etcdctl --user一样: username:password
+	TokenFile string `json:"tokenFile,omitempty"`
+	// 连接超时时间，time.ParseDuration格式，默认5s
+	DialTimeout string `json:"dialTimeout,omitempty"`
+}
@@ -1,9 +1,28 @@
 package structs
 
+import "net"
+
 type NetInfo struct {
 	VlanId    string
 	AppNet    string
 	UseIpList []string
-	IPAddress string
-	GateWay   string
+	// 地址池所在VLAN的master网卡、子接口MTU和macvlan模式，为空时使用NetConf中的配置
+	Master string
+	MTU    int
+	Mode   string
+	// MacPrefix 地址池配置的MAC前缀，为空时使用NetConf中的配置
+	MacPrefix string
+	// 分配到的地址，双栈时IPv4和IPv6各一个
+	IPs []IPInfo
+	// AppNetSource app_net的来源: pod、<Kind>/<name>、namespace或cluster
+	AppNetSource string
+}
+
+// IPInfo 从一个地址池中分配到的地址
+type IPInfo struct {
+	AppNet    string
+	IPAddress net.IP
+	// 地址池网段，掩码用于生成CNI结果
+	Subnet  net.IPNet
+	GateWay net.IP
 }
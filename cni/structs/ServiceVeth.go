@@ -0,0 +1,16 @@
+package structs
+
+// ServiceVethConf NetConf中serviceVeth块的配置
+// pod里多一块veth连到主机，访问Service和集群pod网段的流量经过主机的kube-proxy规则，默认路由还是走macvlan
+type ServiceVethConf struct {
+	// IfName pod里veth的网卡名，默认eth1
+	IfName string `json:"ifName,omitempty"`
+	// Subnet 节点本地的IPv4地址段，pod端的地址从这里分配，主机端使用第一个地址，默认169.254.100.0/22
+	Subnet string `json:"subnet,omitempty"`
+	// ServiceCIDRs Service网段，例如 ["10.96.0.0/12"]
+	ServiceCIDRs []string `json:"serviceCIDRs,omitempty"`
+	// ClusterCIDRs 集群pod网段
+	ClusterCIDRs []string `json:"clusterCIDRs,omitempty"`
+	// DataDir 节点本地地址的分配记录目录，默认/var/lib/cni/ts-cni/service-veth
+	DataDir string `json:"dataDir,omitempty"`
+}
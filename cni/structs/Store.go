@@ -0,0 +1,16 @@
+package structs
+
+import "ts-cni/cni/allocator"
+
+// StoreConf NetConf中store块的配置，选择IPAM存储
+type StoreConf struct {
+	// etcd(默认)或disk(单节点)
+	Type string `json:"type,omitempty"`
+	// disk存储的目录
+	DataDir string `json:"dataDir,omitempty"`
+	// disk存储的地址池，etcd存储的地址池在/ipam下
+	Pools []*allocator.Pool `json:"pools,omitempty"`
+	// PoolSource 为crd时地址池从IPPool/VLANNetwork自定义资源读取，
+	// IP分配记录还是保存在Type指定的存储中
+	PoolSource string `json:"poolSource,omitempty"`
+}
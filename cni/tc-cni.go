@@ -2,20 +2,25 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
-	_ "github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/vishvananda/netlink"
 	"log"
 	"net"
 	"runtime"
 	"strings"
+	"time"
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/ipamd"
 	"ts-cni/cni/structs"
 	"ts-cni/cni/utils"
 )
@@ -25,22 +30,89 @@ type EnvArgs struct {
 	K8sPodNamespace        string `json:"K8S_POD_NAMESPACE"`
 	K8sPodName             string `json:"K8S_POD_NAME"`
 	K8sPodInfraContainerId string `json:"K8S_POD_INFRA_CONTAINER_ID"`
+	// IP CNI_ARGS中指定的IP，双栈时用逗号分隔
+	IP string `json:"IP,omitempty"`
+	// MAC CNI_ARGS中指定的容器网卡MAC，和macvlan插件的MAC=一样
+	MAC string `json:"MAC,omitempty"`
 }
 
 type NetConf struct {
 	types.NetConf
-	Master  string `json:"master"`
-	Mode    string `json:"mode"`
-	MTU     int    `json:"mtu"`
-	Mac     string `json:"mac,omitempty"`
-	EnvArgs EnvArgs
-	NetInfo structs.NetInfo
+	Master     string            `json:"master"`
+	Mode       string            `json:"mode"`
+	MTU        int               `json:"mtu"`
+	Mac        string            `json:"mac,omitempty"`
+	Etcd       structs.EtcdConf  `json:"etcd"`
+	Store      structs.StoreConf `json:"store"`
+	Kubeconfig string            `json:"kubeconfig,omitempty"`
+	VlanMTU    int               `json:"vlanMtu,omitempty"`
+	VlanGC     bool              `json:"vlanGC,omitempty"`
+	StickyIP   bool              `json:"stickyIP,omitempty"`
+	EnvArgs    EnvArgs
+	NetInfo    structs.NetInfo
+
+	// DefaultAppNet pod、工作负载和namespace都没有配置app_net时使用的集群默认地址池
+	DefaultAppNet []string `json:"defaultAppNet,omitempty"`
+	// DaemonSocket 节点上ts-cni-daemon的unix socket，为空时tc-cni自己连etcd和apiserver
+	DaemonSocket string `json:"daemonSocket,omitempty"`
+	// NodeName 节点在k8s中的名字，主机名和Node名字不一样时需要配置，ts-cni-daemon也读这个配置
+	NodeName string `json:"nodeName,omitempty"`
+	// LinkType 容器网卡的类型，macvlan(默认)或ipvlan
+	// ipvlan时mode是l2(默认)、l3或l3s，ipvlanFlag是bridge(默认)、private或vepa
+	LinkType   string `json:"linkType,omitempty"`
+	IpvlanFlag string `json:"ipvlanFlag,omitempty"`
+	// HostShim 在VLAN子接口上建一个bridge模式的macvlan shim，并给每个pod IP加主机路由，让主机能访问pod
+	// shim的地址从pod的地址池中分配，每个节点每个地址池一个
+	HostShim bool `json:"hostShim,omitempty"`
+	// ServiceVeth 配置后pod里多一块连到主机的veth，Service和集群pod网段走veth
+	ServiceVeth *structs.ServiceVethConf `json:"serviceVeth,omitempty"`
+	// GarpCount 配置完网卡后发送免费ARP/IPv6非请求邻居通告的次数，0表示不发送
+	GarpCount int `json:"garpCount,omitempty"`
+	// DAD 配置IP前先做重复地址检测，IPv4用ARP探测，IPv6用内核的DAD
+	// 发现冲突时冲突的IP留在存储里不再分配，换一个IP重试一次，还冲突时ADD失败
+	DAD bool `json:"dad,omitempty"`
+	// MacMode 没有指定mac时容器网卡MAC的来源: random(默认，内核随机生成)或ip(由pod IP生成固定的MAC)
+	// ip模式的MAC是 macPrefix + IP的低位字节，地址池配置了macPrefix时优先使用地址池的
+	MacMode   string `json:"macMode,omitempty"`
+	MacPrefix string `json:"macPrefix,omitempty"`
+
+	// runtimeConfig.ips 由容器运行时按capabilities传进来的指定IP
+	RuntimeConfig struct {
+		IPs []string `json:"ips,omitempty"`
+		Mac string   `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
 //const (
 //	IPv4InterfaceArpProxySysctlTemplate = "net.ipv4.conf.%s.proxy_arp"
 //)
 
+// daemonTimeout 调用ts-cni-daemon的超时时间
+const daemonTimeout = 30 * time.Second
+
+// 重复地址检测的探测次数和超时时间
+const (
+	dadProbes  = 3
+	dadTimeout = 1 * time.Second
+)
+
+// 容器网卡的类型
+const (
+	linkTypeMacvlan = "macvlan"
+	linkTypeIpvlan  = "ipvlan"
+)
+
+// 没有指定mac时容器网卡MAC的来源
+const (
+	macModeRandom = "random"
+	macModeIP     = "ip"
+)
+
+const (
+	IPv6DisableSysctlTemplate   = "net.ipv6.conf.%s.disable_ipv6"
+	IPv6AcceptDadSysctlTemplate = "net.ipv6.conf.%s.accept_dad"
+)
+
 func init() {
 	log.SetPrefix("TC-CNI: ")
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
@@ -89,6 +161,73 @@ func modeFromString(s string) (netlink.MacvlanMode, error) {
 	}
 }
 
+func ipvlanModeFromString(s string) (netlink.IPVlanMode, error) {
+	switch s {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+	}
+}
+
+func ipvlanModeToString(mode netlink.IPVlanMode) (string, error) {
+	switch mode {
+	case netlink.IPVLAN_MODE_L2:
+		return "l2", nil
+	case netlink.IPVLAN_MODE_L3:
+		return "l3", nil
+	case netlink.IPVLAN_MODE_L3S:
+		return "l3s", nil
+	default:
+		return "", fmt.Errorf("unknown ipvlan mode: %q", mode)
+	}
+}
+
+func ipvlanFlagFromString(s string) (netlink.IPVlanFlag, error) {
+	switch s {
+	case "", "bridge":
+		return netlink.IPVLAN_FLAG_BRIDGE, nil
+	case "private":
+		return netlink.IPVLAN_FLAG_PRIVATE, nil
+	case "vepa":
+		return netlink.IPVLAN_FLAG_VEPA, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan flag: %q", s)
+	}
+}
+
+func ipvlanFlagToString(flag netlink.IPVlanFlag) string {
+	switch flag {
+	case netlink.IPVLAN_FLAG_BRIDGE:
+		return "bridge"
+	case netlink.IPVLAN_FLAG_PRIVATE:
+		return "private"
+	case netlink.IPVLAN_FLAG_VEPA:
+		return "vepa"
+	default:
+		return fmt.Sprintf("%d", flag)
+	}
+}
+
+func modeToString(mode netlink.MacvlanMode) (string, error) {
+	switch mode {
+	case netlink.MACVLAN_MODE_BRIDGE:
+		return "bridge", nil
+	case netlink.MACVLAN_MODE_PRIVATE:
+		return "private", nil
+	case netlink.MACVLAN_MODE_VEPA:
+		return "vepa", nil
+	case netlink.MACVLAN_MODE_PASSTHRU:
+		return "passthru", nil
+	default:
+		return "", fmt.Errorf("unknown macvlan mode: %q", mode)
+	}
+}
+
 func loadConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 	n := &NetConf{}
 	if err := json.Unmarshal(bytes, n); err != nil {
@@ -125,7 +264,10 @@ func loadConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		tempMap := make(map[string]string)
 		tempArr := strings.Split(envArgs, ";")
 		for _, v := range tempArr {
-			tempKV := strings.Split(v, "=")
+			tempKV := strings.SplitN(v, "=", 2)
+			if len(tempKV) != 2 {
+				continue
+			}
 			tempMap[tempKV[0]] = tempKV[1]
 		}
 		if tempMap["IgnoreUnknown"] == "1" {
@@ -136,11 +278,50 @@ func loadConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		m.K8sPodNamespace = tempMap["K8S_POD_NAMESPACE"]
 		m.K8sPodName = tempMap["K8S_POD_NAME"]
 		m.K8sPodInfraContainerId = tempMap["K8sPodInfraContainerId"]
+		m.IP = tempMap["IP"]
+		m.MAC = tempMap["MAC"]
 		n.EnvArgs = *m
 		log.Println("CNI envArgs转换后的值=", *m)
 		log.Println("CNI 转换后n的值=", *n)
 	}
 
+	switch n.LinkType {
+	case "", linkTypeMacvlan:
+		n.LinkType = linkTypeMacvlan
+		if n.IpvlanFlag != "" {
+			return nil, "", fmt.Errorf("ipvlanFlag is only supported by linkType %q", linkTypeIpvlan)
+		}
+	case linkTypeIpvlan:
+		if _, err := ipvlanFlagFromString(n.IpvlanFlag); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown linkType: %q", n.LinkType)
+	}
+
+	// 指定MAC的优先级: runtimeConfig.mac > CNI_ARGS MAC= > 配置文件的mac
+	if n.EnvArgs.MAC != "" {
+		n.Mac = n.EnvArgs.MAC
+	}
+	if n.RuntimeConfig.Mac != "" {
+		n.Mac = n.RuntimeConfig.Mac
+	}
+	switch n.MacMode {
+	case "", macModeRandom:
+		n.MacMode = macModeRandom
+	case macModeIP:
+		if n.LinkType != linkTypeMacvlan {
+			return nil, "", fmt.Errorf("macMode %q is only supported by linkType %q", macModeIP, linkTypeMacvlan)
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown macMode: %q", n.MacMode)
+	}
+	if n.MacPrefix != "" {
+		if _, err := allocator.ParseMacPrefix(n.MacPrefix); err != nil {
+			return nil, "", err
+		}
+	}
+
 	// 没有设置网卡就使用默认网卡
 	if n.Master == "" {
 		defaultRouteInterface, err := getDefaultRouteInterfaceName()
@@ -149,81 +330,126 @@ func loadConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		}
 		n.Master = defaultRouteInterface
 	}
-	// 建立k8s连接
-	K8sClient := utils.NewK8s()
-	// 根据n.EnvArgs中当前创建pod的namespace和name，查出对应上层控制器中定义的app_net切片
-	log.Println("当前pod namespace =", n.EnvArgs.K8sPodNamespace)
-	log.Println("当前pod的名称 =", n.EnvArgs.K8sPodName)
-	netArr := K8sClient.GetPodNet(n.EnvArgs.K8sPodNamespace, n.EnvArgs.K8sPodName)
-	log.Println("CNI NetArr的值=", netArr)
-	ipInfo := utils.EtcdCmdAdd(netArr)
-	log.Println("CNI IpInfo=", ipInfo)
-	n.Master = n.Master + "." + ipInfo.VlanId
-	n.NetInfo.AppNet = ipInfo.AppNet
-	n.NetInfo.UseIpList = ipInfo.UseIpList
-	n.NetInfo.IPAddress = ipInfo.IPAddress
-	n.NetInfo.GateWay = ipInfo.GateWay
+	return n, n.CNIVersion, nil
+}
+
+// newIPAM 配置了daemonSocket时通过unix socket调用节点上的ts-cni-daemon，否则在tc-cni进程中直接分配
+// k8sRequired为false时k8s连接只用于释放StatefulSet保留的IP，连不上也不影响
+func newIPAM(n *NetConf, k8sRequired bool) (ipamd.Interface, error) {
+	if n.DaemonSocket != "" {
+		return ipamd.NewClient(n.DaemonSocket, daemonTimeout), nil
+	}
+	store, err := ipamd.NewStore(&n.Etcd, &n.Store, n.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	var K8sClient *utils.K8s
+	if k8sRequired || n.StickyIP {
+		// 建立k8s连接
+		if K8sClient, err = utils.NewK8s(n.Kubeconfig); err != nil {
+			if k8sRequired {
+				store.Close()
+				return nil, err
+			}
+			log.Println("IPAM 连接k8s失败, 继续保留IP, err=", err)
+		}
+	}
+	return ipamd.NewIPAM(store, K8sClient, utils.NodeName(n.NodeName)), nil
+}
+
+// newRequest 根据NetConf和CNI参数生成IPAM请求
+func newRequest(n *NetConf, args *skel.CmdArgs) *ipamd.Request {
+	req := &ipamd.Request{
+		ContainerID:   args.ContainerID,
+		IfName:        args.IfName,
+		PodNamespace:  n.EnvArgs.K8sPodNamespace,
+		PodName:       n.EnvArgs.K8sPodName,
+		StickyIP:      n.StickyIP,
+		DefaultAppNet: n.DefaultAppNet,
+	}
+	// pod指定的IP，优先级: runtimeConfig.ips > CNI_ARGS IP= > pod注解ts-cni/requested-ip
+	if len(n.RuntimeConfig.IPs) > 0 {
+		req.RequestedIPs = n.RuntimeConfig.IPs
+	} else if n.EnvArgs.IP != "" {
+		req.RequestedIPs = utils.SplitList(n.EnvArgs.IP)
+	}
+	return req
+}
+
+// releaseIP 释放这个容器网卡分配到的IP
+func releaseIP(n *NetConf, args *skel.CmdArgs) error {
+	ipamClient, err := newIPAM(n, false)
+	if err != nil {
+		return err
+	}
+	defer ipamClient.Close()
+	return ipamClient.Release(newRequest(n, args))
+}
+
+// allocateIP 根据pod的app_net分配IP，并把master换成对应的VLAN子接口
+func allocateIP(n *NetConf, args *skel.CmdArgs, ipamClient ipamd.Interface) (err error) {
+	req := newRequest(n, args)
+	ipInfo, err := ipamClient.Allocate(req)
+	if err != nil {
+		return err
+	}
+	// Release the IP if err to avoid ip leak
+	defer func() {
+		if err != nil {
+			_ = ipamClient.Release(req)
+		}
+	}()
+	applyNetInfo(n, &ipInfo)
+	// VLAN子接口不存在时自动创建
+	vlanName, err := utils.EnsureVlan(n.Master, ipInfo.VlanId, n.VlanMTU, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = utils.ReleaseVlan(args.ContainerID, args.IfName, n.VlanGC)
+		}
+	}()
+	n.Master = vlanName
+	n.NetInfo = ipInfo
 	log.Println("CNI IP分配信息=", n.Master, n.NetInfo)
-	log.Println("CNI IP分配完后n的信息=", n)
-
-	// 建立etcd连接
-	//etcdClient := utils.EtcdClient{}
-	//etcdClient.EtcdConnect()
-	// 取etcd中存储的所有的网段
-	// 根据Annotations中的app_net
-	// 第一步 查询app_net是否在etcd所有网段中存在
-	// 第二步 如果存在判断app_net的整个网段的IP在etcd中是否超过了240个(11-250)
-	// 第三步 如果超过了，就取app_net中下一个网段，如果没有下一个网段，报地址池IP不够
-	// 第四步 如果没超过240个，就在etcd中取当前网段的vlanID，并且拼接到master上
-	//var etcdRootDir = "/ipam"
-	//netList := etcdClient.EtcdGet(etcdRootDir, true).([]string)
-	//for i, v := range netArr {
-	//	if utils.IsExistString(v, netList) {
-	//		usedIpList := etcdClient.EtcdGet(etcdRootDir+"/"+v, true).([]string)
-	//		if len(usedIpList) < 240 {
-	//			netVlanId := etcdClient.EtcdGet(etcdRootDir+"/"+v, false).([]utils.EtcdGetValue)[0].V
-	//			n.Master = n.Master + "." + netVlanId
-	//			n.NetInfo.AppNet = v
-	//			n.NetInfo.UseIpList = usedIpList
-	//			break
-	//		} else if i == len(usedIpList)-1 {
-	//			return nil, "", fmt.Errorf("%v 的Annotations里的app_net地址池不够了! \n")
-	//		} else {
-	//			log.Printf("%v 这个IP地址段中已经没有IP了! \n", v)
-	//			continue
-	//		}
-	//	} else {
-	//		return nil, "", fmt.Errorf("%v 的Annotations里的app_net写的有问题，找不到! \n", n.EnvArgs.K8sPodName)
-	//	}
-	//}
-	//etcdClient.EtcdDisconnect()
 
 	// 配置MTU，在不设置的情况下就是0 没有什么卵用
 	masterMTU, err := getMTUByName(n.Master)
 	if err != nil {
-		return nil, "", err
+		return err
 	}
 	if n.MTU < 0 || n.MTU > masterMTU {
-		return nil, "", fmt.Errorf("invalid MTU %d, must be [0, master MTU(%d)]", n.MTU, masterMTU)
+		return fmt.Errorf("invalid MTU %d, must be [0, master MTU(%d)]", n.MTU, masterMTU)
 	}
-
-	return n, n.CNIVersion, nil
+	return nil
 }
 
-func createMacvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
-	macvlan := &current.Interface{}
-	// 转化配置文件中的mode
-	mode, err := modeFromString(conf.Mode)
-	if err != nil {
-		return nil, err
+// applyNetInfo 地址池所在的VLANNetwork配置了master、MTU或者模式时，覆盖NetConf中的配置
+func applyNetInfo(n *NetConf, info *structs.NetInfo) {
+	if info.Master != "" {
+		n.Master = info.Master
 	}
-	log.Println("CNI macvlan的mode=", mode)
+	if info.MTU != 0 {
+		n.VlanMTU = info.MTU
+	}
+	if info.Mode != "" {
+		n.Mode = info.Mode
+	}
+	if info.MacPrefix != "" {
+		n.MacPrefix = info.MacPrefix
+	}
+}
+
+// createLink 在master上创建macvlan或ipvlan子接口，移到容器的netns里并改名为ifName
+func createLink(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	contIface := &current.Interface{}
 
 	m, err := netlink.LinkByName(conf.Master)
 	if err != nil {
 		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
 	}
-	log.Println("CNI macvlan的m=", m)
+	log.Println("CNI 子接口的master=", m)
 
 	// 子接口网卡名
 	// due to kernel bug we have to create with tmpName or it might
@@ -246,18 +472,21 @@ func createMacvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Inter
 			return nil, fmt.Errorf("invalid args %v for MAC addr: %v", conf.Mac, err)
 		}
 		linkAttrs.HardwareAddr = addr
+	} else if conf.MacMode == macModeIP {
+		addr, err := macFromIP(conf)
+		if err != nil {
+			return nil, err
+		}
+		linkAttrs.HardwareAddr = addr
 	}
 	log.Println("CNI linkAttrs.HardwareAddr的值=", linkAttrs.HardwareAddr)
-	log.Println("CNI linkAttrs的值=")
 
-	// 整合macvlan所需要的参数
-	mv := &netlink.Macvlan{
-		LinkAttrs: linkAttrs,
-		Mode:      mode,
+	link, err := newLink(conf, linkAttrs)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := netlink.LinkAdd(mv); err != nil {
-		return nil, fmt.Errorf("failed to create macvlan: %v", err)
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", link.Type(), err)
 	}
 
 	err = netns.Do(func(_ ns.NetNS) error {
@@ -265,35 +494,82 @@ func createMacvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Inter
 		//ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
 		//if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
 		//	// remove the newly added link and ignore errors, because we already are in a failed state
-		//	_ = netlink.LinkDel(mv)
+		//	_ = netlink.LinkDel(link)
 		//	return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
 		//}
 
 		err := ip.RenameLink(tmpName, ifName)
 		// 如果改名没改成功就需要把前面创建的网卡 --- 删除
 		if err != nil {
-			_ = netlink.LinkDel(mv)
-			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
+			_ = netlink.LinkDel(link)
+			return fmt.Errorf("failed to rename %s to %q: %v", link.Type(), ifName, err)
 		}
-		macvlan.Name = ifName
+		contIface.Name = ifName
 
-		// Re-fetch macvlan to get all properties/attributes
-		contMacvlan, err := netlink.LinkByName(ifName)
-		log.Println("contMacvlan的值=", contMacvlan)
+		// Re-fetch link to get all properties/attributes
+		contLink, err := netlink.LinkByName(ifName)
+		log.Println("contLink的值=", contLink)
 		if err != nil {
-			return fmt.Errorf("failed to refetch macvlan %q: %v", ifName, err)
+			return fmt.Errorf("failed to refetch %s %q: %v", link.Type(), ifName, err)
 		}
-		macvlan.Mac = contMacvlan.Attrs().HardwareAddr.String()
-		macvlan.Sandbox = netns.Path()
+		// ipvlan和master共用MAC
+		contIface.Mac = contLink.Attrs().HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
 
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	log.Println("CNI macvlan的值=", *macvlan)
+	log.Println("CNI 容器网卡的值=", *contIface)
 	// {eth0 0e:69:d6:07:a9:33 /proc/25981/ns/net}
-	return macvlan, nil
+	return contIface, nil
+}
+
+// macFromIP 由pod IP生成固定的MAC，双栈时使用IPv4地址，IP复用时MAC不变，邻居的ARP缓存不会失效
+func macFromIP(conf *NetConf) (net.HardwareAddr, error) {
+	ips := conf.NetInfo.IPs
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP allocated to generate mac from")
+	}
+	ipInfo := ips[0]
+	for _, v := range ips {
+		if v.IPAddress.To4() != nil {
+			ipInfo = v
+			break
+		}
+	}
+	if err := allocator.CheckMacPrefix(conf.MacPrefix, &ipInfo.Subnet); err != nil {
+		return nil, err
+	}
+	return allocator.MacFromIP(conf.MacPrefix, ipInfo.IPAddress)
+}
+
+// newLink 按linkType整合macvlan或ipvlan所需要的参数
+func newLink(conf *NetConf, linkAttrs netlink.LinkAttrs) (netlink.Link, error) {
+	if conf.LinkType == linkTypeIpvlan {
+		if linkAttrs.HardwareAddr != nil {
+			return nil, fmt.Errorf("ipvlan shares the MAC of master %q, mac can not be set", conf.Master)
+		}
+		mode, err := ipvlanModeFromString(conf.Mode)
+		if err != nil {
+			return nil, err
+		}
+		flag, err := ipvlanFlagFromString(conf.IpvlanFlag)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("CNI ipvlan的mode=", mode, "flag=", flag)
+		return &netlink.IPVlan{LinkAttrs: linkAttrs, Mode: mode, Flag: flag}, nil
+	}
+
+	// 转化配置文件中的mode
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("CNI macvlan的mode=", mode)
+	return &netlink.Macvlan{LinkAttrs: linkAttrs, Mode: mode}, nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -304,6 +580,52 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	log.Println("CNI 加载完配置后n=", n)
 
+	ipamClient, err := newIPAM(n, true)
+	if err != nil {
+		return err
+	}
+	defer ipamClient.Close()
+	err = addNetwork(args, n, cniVersion, ipamClient)
+	// DAD发现冲突时冲突的IP已经留在存储里，换下一个空闲IP再试一次
+	// 第一次分配时改过NetConf中的master等配置，重新加载
+	var conflict *utils.AddressConflictError
+	if errors.As(err, &conflict) {
+		log.Printf("IP %s 冲突, 换一个IP重试: %v \n", conflict.IP, err)
+		if n, cniVersion, err = loadConf(args.StdinData, args.Args); err != nil {
+			return err
+		}
+		err = addNetwork(args, n, cniVersion, ipamClient)
+	}
+	return err
+}
+
+// addNetwork 分配IP，创建并配置容器网卡，失败时回滚已经做了的部分
+func addNetwork(args *skel.CmdArgs, n *NetConf, cniVersion string, ipamClient ipamd.Interface) (err error) {
+	if err = allocateIP(n, args, ipamClient); err != nil {
+		return err
+	}
+
+	// Invoke ipam del if err to avoid ip leak
+	// VLAN子接口的引用也一起去掉，容器网卡在这之前已经删除了
+	// 冲突的IP先标记成冲突记录，不随Release回到地址池
+	defer func() {
+		if err != nil {
+			var conflict *utils.AddressConflictError
+			if errors.As(err, &conflict) {
+				req := newRequest(n, args)
+				req.PodIPs = []net.IP{conflict.IP}
+				req.Conflict = conflict.Error()
+				// 标记失败时IP会回到地址池，不能重试，返回普通错误
+				if markErr := ipamClient.MarkConflict(req); markErr != nil {
+					log.Printf("标记冲突IP失败: %v \n", markErr)
+					err = fmt.Errorf("%v, failed to mark it as conflict: %v", err, markErr)
+				}
+			}
+			_ = ipamClient.Release(newRequest(n, args))
+			_ = utils.ReleaseVlan(args.ContainerID, args.IfName, n.VlanGC)
+		}
+	}()
+
 	// 网络命名空间
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -312,12 +634,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 	log.Println("CNI 网络命名空间netns=", netns)
 	defer netns.Close()
 
-	// macvlanInterface参数： {eth0 82:e1:18:79:a4:5d /proc/10491/ns/net}
-	macvlanInterface, err := createMacvlan(n, args.IfName, netns)
+	// 容器网卡参数： {eth0 82:e1:18:79:a4:5d /proc/10491/ns/net}
+	contInterface, err := createLink(n, args.IfName, netns)
 	if err != nil {
 		return err
 	}
-	log.Println("macvlanInterface参数=", *macvlanInterface)
+	log.Println("容器网卡参数=", *contInterface)
 
 	// Delete link if err to avoid link leak in this ns
 	defer func() {
@@ -330,58 +652,372 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result := &current.Result{
 		CNIVersion: cniVersion,
-		Interfaces: []*current.Interface{macvlanInterface},
-	}
-
-	// 先不管他 太烦了
-	/*
-		//isLayer3 := n.IPAM.Type != ""
-		//if isLayer3 {
-		//	// run the IPAM plugin and get back the config to apply
-		//	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
-		//	log.Println("r的值:", r)
-		//	// r的值: &{0.3.1 [] [{Version:4 Interface:<nil> Address:{IP:192.168.165.22 Mask:ffffff00} Gateway:192.168.165.2}]
-		//	//[{Dst:{IP:0.0.0.0 Mask:00000000} GW:<nil>}] {[]  [] []}}
-		//	if err != nil {
-		//		return err
-		//	}
-		//
-		//	// Invoke ipam del if err to avoid ip leak
-		//	defer func() {
-		//		if err != nil {
-		//			ipam.ExecDel(n.IPAM.Type, args.StdinData)
-		//		}
-		//	}()
-		//
-		//	// Convert whatever the IPAM result was into the current Result type
-		//	ipamResult, err := current.NewResultFromResult(r)
-		//	log.Println("ipamResult的值:", *ipamResult)
-		//	// ipamResult的值: {0.4.0 [] [{Version:4 Interface:<nil> Address:{IP:192.168.165.22 Mask:ffffff00} Gateway:192.168.165.2}]
-		//	//[{Dst:{IP:0.0.0.0 Mask:00000000} GW:<nil>}] {[]  [] []}}
-		//	// CNIVersion 0.4.0
-		//	// Interfaces []
-		//	// IPs [{Version:4 Interface:<nil> Address:{IP:192.168.165.22 Mask:ffffff00} Gateway:192.168.165.2}]
-		//	// Routes [{Dst:{IP:0.0.0.0 Mask:00000000} GW:<nil>}]
-		//	// DNS {[]  [] []}}
-		//
-		//
-		//
-		//} else {
-		//	return fmt.Errorf("IPAM的Type不存在! 值=%v", n.IPAM.Type)
-		//}
-	*/
+		Interfaces: []*current.Interface{contInterface},
+	}
+	// 双栈时IPv4和IPv6各一个IPConfig和默认路由
+	for i := range n.NetInfo.IPs {
+		result.IPs = append(result.IPs, newIPConfig(&n.NetInfo.IPs[i]))
+		result.Routes = append(result.Routes, defaultRoute(&n.NetInfo.IPs[i]))
+	}
+
+	// shim地址在配置pod网卡之前拿到，pod里到节点IP的路由由ConfigureIface一起加上
+	var shimIPs []net.IP
+	if n.HostShim && shimSupported(n) {
+		var shimRoutes []*types.Route
+		if shimIPs, shimRoutes, err = hostShimIPs(n, ipamClient); err != nil {
+			return err
+		}
+		result.Routes = append(result.Routes, shimRoutes...)
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		if err := configureIPv6Sysctls(args.IfName, result.IPs, n.DAD); err != nil {
+			return err
+		}
+		if n.DAD {
+			if err := probeIPv4(args.IfName, result.IPs); err != nil {
+				return err
+			}
+		}
+		// 配置IP、路由，并把网卡up起来
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+		if n.DAD && hasIPv6(result.IPs) {
+			if err := utils.WaitIPv6DAD(args.IfName, dadTimeout+time.Second); err != nil {
+				return err
+			}
+		}
+		if n.GarpCount > 0 {
+			// 通告只是尽量让邻居更新缓存，失败不影响pod创建
+			if err := utils.AnnounceIPs(args.IfName, podIPs(result.IPs), n.GarpCount); err != nil {
+				log.Printf("发送免费ARP/邻居通告失败: %v \n", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	resIp := n.NetInfo.IPAddress
-	resGw := n.NetInfo.GateWay
-	result.IPs[0].Address.IP = []byte(resIp)
-	result.IPs[0].Address.Mask = []byte("ffffff00")
-	result.IPs[0].Gateway = []byte(resGw)
+	if len(shimIPs) > 0 {
+		if err = utils.AddShimRoutes(n.Master, args.ContainerID, args.IfName, podIPs(result.IPs), shimIPs); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = utils.DelShimRoutes(args.ContainerID, args.IfName)
+			}
+		}()
+	}
+
+	if n.ServiceVeth != nil {
+		var serviceVeth *utils.ServiceVeth
+		if serviceVeth, err = utils.AddServiceVeth(n.ServiceVeth, args.ContainerID, netns); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = utils.DelServiceVeth(n.ServiceVeth, args.ContainerID, args.Netns)
+			}
+		}()
+		// veth的地址是节点本地的，不放到result.IPs里，免得被当成pod IP
+		result.Interfaces = append(result.Interfaces, serviceVeth.Host, serviceVeth.Container)
+		result.Routes = append(result.Routes, serviceVeth.Routes...)
+	}
+
+	result.DNS = n.DNS
+	// 分配结果写回pod注解，失败不影响pod创建
+	req := newRequest(n, args)
+	req.Mac = contInterface.Mac
+	if err := ipamClient.Annotate(req, n.NetInfo); err != nil {
+		log.Printf("写pod注解失败: %v \n", err)
+	}
 	log.Println("CNI 最终result的值=", result)
 	return types.PrintResult(result, cniVersion)
 }
 
+// shimSupported 只有bridge模式的macvlan能和shim互通
+func shimSupported(n *NetConf) bool {
+	if n.LinkType != linkTypeMacvlan || (n.Mode != "" && n.Mode != "bridge") {
+		log.Printf("hostShim只支持bridge模式的macvlan, 当前是%s %s, 不加主机路由 \n", n.LinkType, n.Mode)
+		return false
+	}
+	return true
+}
+
+// hostShimIPs 节点shim在pod地址池中的地址，以及pod里经过shim回到节点IP的路由
+func hostShimIPs(n *NetConf, ipamClient ipamd.Interface) ([]net.IP, []*types.Route, error) {
+	shimInfo, err := ipamClient.ShimIPs(n.NetInfo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get shim IPs: %v", err)
+	}
+	var shimIPs []net.IP
+	for _, info := range shimInfo.IPs {
+		shimIPs = append(shimIPs, info.IPAddress)
+	}
+	nodeIPs, err := utils.NodeIPs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get node IPs: %v", err)
+	}
+	return shimIPs, utils.ShimPodRoutes(nodeIPs, shimIPs), nil
+}
+
+// configureIPv6Sysctls 容器里有IPv6地址时打开disable_ipv6，dad为false时关掉DAD
+// IP由IPAM保证不重复，DAD只会让地址在一段时间内处于tentative状态不能用；
+// 只有网络里可能有IPAM之外的地址(例如IP刚被复用)时才需要打开
+func configureIPv6Sysctls(ifName string, ips []*current.IPConfig, dad bool) error {
+	if !hasIPv6(ips) {
+		return nil
+	}
+	for _, iface := range []string{"lo", ifName} {
+		if _, err := sysctl.Sysctl(fmt.Sprintf(IPv6DisableSysctlTemplate, iface), "0"); err != nil {
+			return fmt.Errorf("failed to enable IPv6 on %q: %v", iface, err)
+		}
+	}
+	acceptDad := "0"
+	if dad {
+		acceptDad = "1"
+	}
+	if _, err := sysctl.Sysctl(fmt.Sprintf(IPv6AcceptDadSysctlTemplate, ifName), acceptDad); err != nil {
+		return fmt.Errorf("failed to set DAD on %q: %v", ifName, err)
+	}
+	return nil
+}
+
+func hasIPv6(ips []*current.IPConfig) bool {
+	for _, ipc := range ips {
+		if ipc.Version == "6" {
+			return true
+		}
+	}
+	return false
+}
+
+func podIPs(ips []*current.IPConfig) []net.IP {
+	var addrs []net.IP
+	for _, ipc := range ips {
+		addrs = append(addrs, ipc.Address.IP)
+	}
+	return addrs
+}
+
+// probeIPv4 配置IP之前用ARP探测确认IPv4地址没有被其他主机占用，探测要求网卡已经up
+func probeIPv4(ifName string, ips []*current.IPConfig) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
+	}
+	for _, ipc := range ips {
+		if ipc.Version != "4" {
+			continue
+		}
+		if err := utils.ArpProbe(ifName, ipc.Address.IP, dadProbes, dadTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newIPConfig 把分配到的IP转成CNI结果，IP都配在第0块网卡(macvlan)上
+func newIPConfig(info *structs.IPInfo) *current.IPConfig {
+	version := "4"
+	if info.IPAddress.To4() == nil {
+		version = "6"
+	}
+	return &current.IPConfig{
+		Version:   version,
+		Interface: current.Int(0),
+		Address:   net.IPNet{IP: info.IPAddress, Mask: info.Subnet.Mask},
+		Gateway:   info.GateWay,
+	}
+}
+
+// defaultRoute 经过地址池网关的默认路由
+func defaultRoute(info *structs.IPInfo) *types.Route {
+	dst := net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	if info.IPAddress.To4() == nil {
+		dst = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &types.Route{Dst: dst, GW: info.GateWay}
+}
+
 func cmdCheck(args *skel.CmdArgs) error {
 	log.Println("cmdCheck 中的args=", *args)
+	n, _, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap current.Interface
+	// Find interfaces for names whe know, macvlan/ipvlan device name inside container
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name {
+			if args.Netns == intf.Sandbox {
+				contMap = *intf
+				continue
+			}
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+
+	// 根据prevResult中的IP到etcd中找到地址池，确认分配记录还在，并得到VLAN子接口
+	if len(result.IPs) == 0 {
+		return fmt.Errorf("prevResult中没有IP")
+	}
+	ipamClient, err := newIPAM(n, false)
+	if err != nil {
+		return err
+	}
+	defer ipamClient.Close()
+	req := newRequest(n, args)
+	for _, ipc := range result.IPs {
+		req.PodIPs = append(req.PodIPs, ipc.Address.IP)
+	}
+	ipInfo, err := ipamClient.Check(req)
+	if err != nil {
+		return err
+	}
+	applyNetInfo(n, &ipInfo)
+	n.Master = utils.VlanName(n.Master, ipInfo.VlanId)
+	log.Println("cmdCheck 中的master=", n.Master)
+
+	m, err := netlink.LinkByName(n.Master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", n.Master, err)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	return netns.Do(func(_ ns.NetNS) error {
+		// Check interface against values found in the container
+		err := validateCniContainerInterface(contMap, m.Attrs().Index, n)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedRoute(result.Routes)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// validateCniContainerInterface 检查容器里的网卡是不是挂在master上、类型和mode正确的macvlan或ipvlan
+func validateCniContainerInterface(intf current.Interface, parentIndex int, conf *NetConf) error {
+	if intf.Name == "" {
+		return fmt.Errorf("Container interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("Container Interface name in prevResult: %s not found", intf.Name)
+	}
+	if intf.Sandbox == "" {
+		return fmt.Errorf("Error: Container interface %s should not be in host namespace", link.Attrs().Name)
+	}
+
+	if link.Type() != conf.LinkType {
+		return fmt.Errorf("Error: Container interface %s not of type %s", link.Attrs().Name, conf.LinkType)
+	}
+
+	if link.Attrs().ParentIndex != parentIndex {
+		return fmt.Errorf("Container %s %s parent index %d does not match master index %d",
+			conf.LinkType, intf.Name, link.Attrs().ParentIndex, parentIndex)
+	}
+
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		if err := validateMacvlanMode(l, conf.Mode); err != nil {
+			return err
+		}
+	case *netlink.IPVlan:
+		if err := validateIpvlanMode(l, conf.Mode, conf.IpvlanFlag); err != nil {
+			return err
+		}
+	}
+
+	if intf.Mac != "" {
+		if intf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("Interface %s Mac %s doesn't match container Mac: %s", intf.Name, intf.Mac, link.Attrs().HardwareAddr)
+		}
+	}
+
+	return nil
+}
+
+func validateMacvlanMode(macv *netlink.Macvlan, modeExpected string) error {
+	mode, err := modeFromString(modeExpected)
+	if err != nil {
+		return err
+	}
+	if macv.Mode != mode {
+		currString, err := modeToString(macv.Mode)
+		if err != nil {
+			return err
+		}
+		confString, err := modeToString(mode)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Container macvlan mode %s does not match expected value: %s", currString, confString)
+	}
+	return nil
+}
+
+func validateIpvlanMode(ipv *netlink.IPVlan, modeExpected string, flagExpected string) error {
+	mode, err := ipvlanModeFromString(modeExpected)
+	if err != nil {
+		return err
+	}
+	if ipv.Mode != mode {
+		currString, err := ipvlanModeToString(ipv.Mode)
+		if err != nil {
+			return err
+		}
+		confString, err := ipvlanModeToString(mode)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Container ipvlan mode %s does not match expected value: %s", currString, confString)
+	}
+	flag, err := ipvlanFlagFromString(flagExpected)
+	if err != nil {
+		return err
+	}
+	if ipv.Flag != flag {
+		return fmt.Errorf("Container ipvlan flag %s does not match expected value: %s", ipvlanFlagToString(ipv.Flag), ipvlanFlagToString(flag))
+	}
 	return nil
 }
 
@@ -393,26 +1029,39 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 	log.Println("cmdDel中的n=", n)
-	podName := n.EnvArgs.K8sPodName
-	podNameSpace := n.EnvArgs.K8sPodNamespace
-	utils.EtcdCmdDel(podNameSpace, podName)
+	// 按容器ID和网卡名释放IP，不依赖apiserver中的pod
+	if err := releaseIP(n, args); err != nil {
+		return err
+	}
 
-	if args.Netns == "" {
-		return nil
+	if n.ServiceVeth != nil {
+		if err := utils.DelServiceVeth(n.ServiceVeth, args.ContainerID, args.Netns); err != nil {
+			return err
+		}
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		if err := ip.DelLinkByName(args.IfName); err != nil {
-			if err != ip.ErrLinkNotFound {
-				return err
+	if args.Netns != "" {
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device is already removed.
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			if err := ip.DelLinkByName(args.IfName); err != nil {
+				if err != ip.ErrLinkNotFound {
+					return err
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+	}
 
-	return err
+	// 没有开hostShim时没有记录，什么都不做
+	if err := utils.DelShimRoutes(args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+	// macvlan删掉以后再释放VLAN子接口的引用
+	return utils.ReleaseVlan(args.ContainerID, args.IfName, n.VlanGC)
 }
 
 func main() {
@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+)
+
+// announceInterval 连续发送免费ARP/非请求NA的间隔
+const announceInterval = 200 * time.Millisecond
+
+const (
+	arpRequest = 1
+	// arpPacketLen 以太网上IPv4 ARP报文的长度，不含以太网头
+	arpPacketLen = 28
+)
+
+// ErrAddressInUse DAD发现IP已经被其他主机使用
+var ErrAddressInUse = errors.New("address already in use")
+
+// AddressConflictError DAD发现冲突的IP，errors.Is(err, ErrAddressInUse)为true
+type AddressConflictError struct {
+	IP net.IP
+	// Owner 占用这个IP的主机的MAC，IPv6 DAD失败时不知道是谁
+	Owner net.HardwareAddr
+}
+
+func (e *AddressConflictError) Error() string {
+	if e.Owner != nil {
+		return fmt.Sprintf("%v: %s is used by %s", ErrAddressInUse, e.IP, e.Owner)
+	}
+	return fmt.Sprintf("%v: %s", ErrAddressInUse, e.IP)
+}
+
+func (e *AddressConflictError) Unwrap() error {
+	return ErrAddressInUse
+}
+
+// AnnounceIPs 从容器网卡发送count轮免费ARP(IPv4)和非请求邻居通告(IPv6)，
+// 让交换机和网关更新IP快速复用后残留的旧MAC
+// 必须在容器的netns里调用，网卡是NOARP(ipvlan L3/L3S)时不发送
+func AnnounceIPs(ifName string, ips []net.IP, count int) error {
+	iface, noARP, err := neighIface(ifName)
+	if err != nil || noARP {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		for _, ip := range ips {
+			if v4 := ip.To4(); v4 != nil {
+				err = arping.GratuitousArpOverIface(v4, *iface)
+			} else {
+				err = sendUnsolicitedNA(iface, ip)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to announce %s on %q: %v", ip, ifName, err)
+			}
+		}
+	}
+	log.Printf("在 %s 上通告了 %v %d 次 \n", ifName, ips, count)
+	return nil
+}
+
+// ArpProbe 按RFC 5227发送probes次ARP探测(发送方IP为0.0.0.0)，timeout内有其他MAC声明或探测同一个IP就认为冲突
+// 必须在容器的netns里、配置IP之前调用，网卡需要是up的
+func ArpProbe(ifName string, ip net.IP, probes int, timeout time.Duration) error {
+	ip = ip.To4()
+	if ip == nil {
+		return fmt.Errorf("ARP probe only supports IPv4")
+	}
+	iface, noARP, err := neighIface(ifName)
+	if err != nil || noARP {
+		return err
+	}
+	if probes < 1 {
+		probes = 1
+	}
+
+	proto := htons(syscall.ETH_P_ARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(proto))
+	if err != nil {
+		return fmt.Errorf("failed to open ARP socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		return fmt.Errorf("failed to bind ARP socket to %q: %v", ifName, err)
+	}
+	tv := syscall.NsecToTimeval(int64(50 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	dst := &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index, Halen: 6}
+	copy(dst.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	probe := arpPacket(iface.HardwareAddr, net.IPv4zero.To4(), ip)
+	interval := timeout / time.Duration(probes)
+	buf := make([]byte, 128)
+	for i := 0; i < probes; i++ {
+		if err := syscall.Sendto(fd, probe, 0, dst); err != nil {
+			return fmt.Errorf("failed to send ARP probe for %s: %v", ip, err)
+		}
+		for next := time.Now().Add(interval); time.Now().Before(next); {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EAGAIN || err == syscall.EINTR {
+					continue
+				}
+				return fmt.Errorf("failed to receive ARP: %v", err)
+			}
+			if mac := arpConflict(buf[:n], iface.HardwareAddr, ip); mac != nil {
+				return &AddressConflictError{IP: ip, Owner: mac}
+			}
+		}
+	}
+	return nil
+}
+
+// WaitIPv6DAD 等内核对网卡上的IPv6地址做完DAD，有地址DAD失败时返回ErrAddressInUse
+func WaitIPv6DAD(ifName string, timeout time.Duration) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+		}
+		tentative := false
+		for _, addr := range addrs {
+			if addr.Flags&syscall.IFA_F_DADFAILED != 0 {
+				return &AddressConflictError{IP: addr.IP}
+			}
+			if addr.Flags&syscall.IFA_F_TENTATIVE != 0 {
+				tentative = true
+			}
+		}
+		if !tentative {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%q still has tentative IPv6 addresses after %v", ifName, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// arpConflict 收到的ARP是其他主机在使用或探测ip时，返回对方的MAC
+func arpConflict(packet []byte, ourMac net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	if len(packet) < arpPacketLen {
+		return nil
+	}
+	sha := net.HardwareAddr(packet[8:14])
+	spa, tpa := net.IP(packet[14:18]), net.IP(packet[24:28])
+	if bytes.Equal(sha, ourMac) {
+		return nil
+	}
+	if spa.Equal(ip) {
+		return sha
+	}
+	// 另一台主机同时在探测这个IP
+	if binary.BigEndian.Uint16(packet[6:8]) == arpRequest && spa.Equal(net.IPv4zero) && tpa.Equal(ip) {
+		return sha
+	}
+	return nil
+}
+
+// arpPacket IPv4 ARP请求，不含以太网头
+func arpPacket(sha net.HardwareAddr, spa net.IP, tpa net.IP) []byte {
+	b := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(b[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(b[2:4], syscall.ETH_P_IP)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:8], arpRequest)
+	copy(b[8:14], sha)
+	copy(b[14:18], spa.To4())
+	copy(b[24:28], tpa.To4())
+	return b
+}
+
+// sendUnsolicitedNA 发送Override置位的非请求邻居通告到ff02::1，校验和由内核计算
+func sendUnsolicitedNA(iface *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// 邻居发现报文的hop limit必须是255
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return err
+	}
+	src := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(src.Addr[:], ip.To16())
+	if err := syscall.Bind(fd, src); err != nil {
+		return err
+	}
+
+	msg := make([]byte, 32)
+	msg[0] = 136  // Neighbor Advertisement
+	msg[4] = 0x20 // Override
+	copy(msg[8:24], ip.To16())
+	msg[24], msg[25] = 2, 1 // Target Link-Layer Address
+	copy(msg[26:32], iface.HardwareAddr)
+
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, msg, 0, dst)
+}
+
+// neighIface 网卡信息，以及网卡是否是NOARP
+func neighIface(ifName string) (*net.Interface, bool, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, false, err
+	}
+	return iface, link.Attrs().RawFlags&syscall.IFF_NOARP != 0, nil
+}
+
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
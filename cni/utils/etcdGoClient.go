@@ -4,54 +4,96 @@ import (
 	"context"
 	"fmt"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/pkg/transport"
+	"io/ioutil"
 	"log"
-	"strconv"
 	"strings"
 	"time"
+	"ts-cni/cni/structs"
 )
 
 type EtcdGetValue struct {
 	K string
 	V string
+	// ModRevision 用于EtcdDeleteIf
+	ModRevision int64
 }
 
-// EtcdClient 分布式锁(TXN事务)
+// EtcdClient etcd客户端，IP的占用和释放都是TXN事务
 type EtcdClient struct {
 	// etcd客户端
-	cli        clientv3.Client
-	Kv         clientv3.KV
-	Lease      clientv3.Lease
-	CancelFunc context.CancelFunc // 用于终止自动续租
-	LeaseId    clientv3.LeaseID   // 租约ID
-	IsLocked   bool               // 是否上锁成功
-	txn        clientv3.Txn
+	cli *clientv3.Client
 }
 
-// EtcdConnect etcd建立连接
-func (c *EtcdClient) EtcdConnect() {
+// 没有配置dialTimeout时默认的连接超时时间
+const defaultEtcdDialTimeout = 5 * time.Second
+
+// NewEtcdClient 根据NetConf中的etcd配置建立连接
+func NewEtcdClient(conf *structs.EtcdConf) (*EtcdClient, error) {
+	if conf == nil || len(conf.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd endpoints未配置")
+	}
+	dialTimeout := defaultEtcdDialTimeout
+	if conf.DialTimeout != "" {
+		d, err := time.ParseDuration(conf.DialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid etcd dialTimeout %q: %v", conf.DialTimeout, err)
+		}
+		dialTimeout = d
+	}
 	config := clientv3.Config{
-		//Endpoints: []string{"192.168.1.25:2379"},
-		Endpoints:   []string{"172.17.47.201:2379"},
-		DialTimeout: 5 * time.Second,
+		Endpoints:   conf.Endpoints,
+		DialTimeout: dialTimeout,
+		Username:    conf.Username,
+		Password:    conf.Password,
+	}
+
+	// 从TokenFile中读取用户名密码，格式 username:password
+	if conf.TokenFile != "" {
+		token, err := ioutil.ReadFile(conf.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read etcd tokenFile %q: %v", conf.TokenFile, err)
+		}
+		userPass := strings.SplitN(strings.TrimSpace(string(token)), ":", 2)
+		if len(userPass) != 2 || userPass[0] == "" {
+			return nil, fmt.Errorf("etcd tokenFile %q 格式不对, 应该是 username:password", conf.TokenFile)
+		}
+		config.Username = userPass[0]
+		config.Password = userPass[1]
+	}
+
+	// 配了任意一个证书就开启TLS
+	if conf.CAFile != "" || conf.CertFile != "" || conf.KeyFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      conf.CertFile,
+			KeyFile:       conf.KeyFile,
+			TrustedCAFile: conf.CAFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load etcd TLS config: %v", err)
+		}
+		config.TLS = tlsConfig
 	}
+
 	cli, err := clientv3.New(config)
 	if err != nil {
-		fmt.Println("connect to etcd failed,err:", err)
-		return
+		return nil, fmt.Errorf("connect to etcd %v failed: %v", conf.Endpoints, err)
 	}
-	c.cli = *cli
+	return &EtcdClient{cli: cli}, nil
 }
 
 // EtcdPut 创建和更新键值
-func (c *EtcdClient) EtcdPut(k string, v string) {
+func (c *EtcdClient) EtcdPut(k string, v string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	putRes, err := c.cli.Put(ctx, k, v, clientv3.WithPrevKV())
 	cancel()
 	if err != nil {
 		log.Println("EtcdPut failed err:", err, "shit!")
-		return
+		return err
 	}
 	log.Println("put的上一次值", putRes.PrevKv)
+	return nil
 }
 
 // EtcdGet 通过isDir来控制get目录还是get具体的值
@@ -96,6 +138,47 @@ func (c *EtcdClient) EtcdGet(k string, isDir bool) interface{} {
 	}
 }
 
+// EtcdGetPrefix 查询前缀下所有的键值，出错时返回error
+func (c *EtcdClient) EtcdGetPrefix(prefix string) ([]EtcdGetValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	getRes, err := c.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	kvSlice := make([]EtcdGetValue, 0, len(getRes.Kvs))
+	for _, ev := range getRes.Kvs {
+		kvSlice = append(kvSlice, EtcdGetValue{K: string(ev.Key), V: string(ev.Value), ModRevision: ev.ModRevision})
+	}
+	return kvSlice, nil
+}
+
+// EtcdGetKey 精确获取一个key，不存在时返回nil
+func (c *EtcdClient) EtcdGetKey(key string) (*EtcdGetValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	getRes, err := c.cli.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(getRes.Kvs) == 0 {
+		return nil, nil
+	}
+	ev := getRes.Kvs[0]
+	return &EtcdGetValue{K: string(ev.Key), V: string(ev.Value), ModRevision: ev.ModRevision}, nil
+}
+
+// EtcdDelete 删除一个键，返回是否真的删掉了
+func (c *EtcdClient) EtcdDelete(k string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	delResp, err := c.cli.Delete(ctx, k)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	return delResp.Deleted > 0, nil
+}
+
 // EtcdDel 删除一个键
 func (c *EtcdClient) EtcdDel(k string) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -115,95 +198,46 @@ func (c *EtcdClient) EtcdDisconnect() {
 	}
 }
 
-// InitLock 初始化锁
-func (c *EtcdClient) InitLock() error {
-	var ctx context.Context
-	c.Kv = clientv3.NewKV(&c.cli)
-	c.Lease = clientv3.NewLease(&c.cli)
-	leaseResp, err := c.Lease.Grant(context.TODO(), 10)
-	if err != nil {
-		return err
-	}
-	ctx, c.CancelFunc = context.WithCancel(context.TODO())
-	c.LeaseId = leaseResp.ID
-	log.Println("锁内存地址:", &c.LeaseId)
-	KeepResChan, err := c.Lease.KeepAlive(ctx, c.LeaseId)
-	go func() {
-		var keepRes *clientv3.LeaseKeepAliveResponse
-		for {
-			select {
-			case keepRes = <-KeepResChan:
-				//如果续约失败
-				if keepRes != nil {
-					log.Println("续租成功,leaseID :", keepRes.ID)
-					log.Println("锁内存地址:", &keepRes.ID)
-				} else {
-					log.Println("续租失败")
-					c.CancelFunc()
-					return
-				}
-			}
-			time.Sleep(1 * time.Second)
-		}
-	}()
-	return err
-}
-
-// Lock 创建锁
-func (c *EtcdClient) Lock(key string) error {
-	// 初始化锁，一般用于创建前
-	err := c.InitLock()
-	if err != nil {
-		return err
-	}
-	txn := c.Kv.Txn(context.TODO())
-	// 判断锁是否存在
-	txn.If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
-		Then(clientv3.OpPut(key, strconv.FormatInt(int64(c.LeaseId), 10), clientv3.WithLease(c.LeaseId))).
-		Else()
-	txnResp, err := txn.Commit()
+// EtcdReserve 用一个事务占用key: key不存在(CreateRevision == 0)时才写入value
+// 不挂租约，插件进程退出后记录一直保留到被释放，key已经存在时返回false
+func (c *EtcdClient) EtcdReserve(key string, value string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	txnResp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	cancel()
 	if err != nil {
-		return err
+		return false, err
 	}
-	// 判断锁是否存在
-	if !txnResp.Succeeded { //判断txn.if条件是否成立
-		return fmt.Errorf("抢锁失败")
-	}
-	return nil
+	return txnResp.Succeeded, nil
 }
 
-// UnLock 通过锁的字符串删除锁
-func (c *EtcdClient) UnLock(leaseIdStr string) error {
-	leaseId := c.SearchLocks(leaseIdStr)
-	revoke, err := c.cli.Revoke(context.TODO(), leaseId)
+// EtcdDeleteIf 有条件的删除: key的ModRevision没变时才删除，
+// 防止读出来以后被别人重新占用的key被误删
+func (c *EtcdClient) EtcdDeleteIf(key string, modRevision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	txnResp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	cancel()
 	if err != nil {
-		log.Printf("获取%v锁出错, %v", leaseIdStr, err)
-		return err
+		return false, err
 	}
-	log.Println("清除锁成功，返回值=", revoke.Header)
-	return nil
+	return txnResp.Succeeded, nil
 }
 
-// SearchLocks 通过锁字符串查询出具体锁的id
-func (c *EtcdClient) SearchLocks(leaseIdStr string) clientv3.LeaseID {
-	leases, err := c.cli.Leases(context.TODO())
-	errId := clientv3.LeaseID(-000000000000)
+// EtcdPutIf 有条件的更新: key的ModRevision没变时才写入
+func (c *EtcdClient) EtcdPutIf(key string, value string, modRevision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	txnResp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	cancel()
 	if err != nil {
-		log.Println("获取所有锁出错,", err)
-		return errId
-	}
-	log.Println(leases.Leases)
-	if leases != nil {
-		for _, i := range leases.Leases {
-			if leaseIdStr == strconv.FormatInt(int64(i.ID), 10) {
-				log.Println("锁内存地址:", &i.ID)
-				log.Println("i=", i.ID)
-				return i.ID
-			}
-		}
-	} else {
-		log.Println("没有锁了")
-		return errId
+		return false, err
 	}
-	return errId
+	return txnResp.Succeeded, nil
 }
@@ -0,0 +1,260 @@
+package utils_test
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"ts-cni/cni/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func ownerRef(apiVersion, kind, name string) metaV1.OwnerReference {
+	controller := true
+	return metaV1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, Controller: &controller}
+}
+
+func newOwner(apiVersion, kind, name string, annotations map[string]string, owners ...metaV1.OwnerReference) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetNamespace("default")
+	u.SetName(name)
+	u.SetAnnotations(annotations)
+	u.SetOwnerReferences(owners)
+	return u
+}
+
+func newPod(name string, annotations map[string]string, owners ...metaV1.OwnerReference) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metaV1.ObjectMeta{
+		Namespace:       "default",
+		Name:            name,
+		Annotations:     annotations,
+		OwnerReferences: owners,
+	}}
+}
+
+var _ = Describe("GetPodNet", func() {
+	var k8s *utils.K8s
+
+	BeforeEach(func() {
+		replicas := int32(2)
+		mapper := meta.NewDefaultRESTMapper(nil)
+		for _, gvk := range []schema.GroupVersionKind{
+			{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+			{Group: "apps", Version: "v1", Kind: "Deployment"},
+			{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+			{Group: "batch", Version: "v1", Kind: "Job"},
+			{Group: "batch", Version: "v1beta1", Kind: "CronJob"},
+			{Group: "example.com", Version: "v1", Kind: "Rollout"},
+		} {
+			mapper.Add(gvk, meta.RESTScopeNamespace)
+		}
+
+		client := fake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "default", Annotations: map[string]string{"app_net": "ns-net"}}},
+			newPod("web-abc-1", nil, ownerRef("apps/v1", "ReplicaSet", "web-abc")),
+			newPod("orphan-abc-1", nil, ownerRef("apps/v1", "ReplicaSet", "orphan-abc")),
+			newPod("db-0", nil, ownerRef("apps/v1", "StatefulSet", "db")),
+			&appsv1.StatefulSet{
+				ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "db"},
+				Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+			},
+			newPod("backup-1-x", map[string]string{"app_net": "pod-net"}, ownerRef("batch/v1", "Job", "backup-1")),
+			newPod("canary-x", nil, ownerRef("example.com/v1", "Rollout", "canary")),
+			newPod("bare", map[string]string{"app_net": "pod-net"}),
+			newPod("plain", nil),
+			&corev1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "other"}},
+			&corev1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: "other", Name: "lonely"}},
+		)
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+			newOwner("apps/v1", "ReplicaSet", "web-abc", nil, ownerRef("apps/v1", "Deployment", "web")),
+			newOwner("apps/v1", "Deployment", "web", map[string]string{"app_net": "net1, net2"}),
+			newOwner("apps/v1", "StatefulSet", "db", map[string]string{"app_net": "db-net"}),
+			newOwner("batch/v1", "Job", "backup-1", nil, ownerRef("batch/v1beta1", "CronJob", "backup")),
+			newOwner("batch/v1beta1", "CronJob", "backup", map[string]string{"app_net": "cron-net"}),
+			newOwner("example.com/v1", "Rollout", "canary", map[string]string{"app_net": "rollout-net"}),
+		)
+		k8s = utils.NewK8sForClients(client, dynamicClient, mapper)
+	})
+
+	DescribeTable("resolves app_net from the pod, the top-level controller, the namespace, then the cluster default",
+		func(namespace, podName string, expected []string, source string) {
+			netArr, resolved, err := k8s.ResolvePodNet(namespace, podName, []string{"cluster-net"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netArr).To(Equal(expected))
+			Expect(resolved).To(Equal(source))
+		},
+		Entry("Deployment", "default", "web-abc-1", []string{"net1", "net2"}, "Deployment/web"),
+		Entry("StatefulSet", "default", "db-0", []string{"db-net"}, "StatefulSet/db"),
+		Entry("pod annotation over the CronJob", "default", "backup-1-x", []string{"pod-net"}, "pod"),
+		Entry("custom controller", "default", "canary-x", []string{"rollout-net"}, "Rollout/canary"),
+		Entry("bare pod", "default", "bare", []string{"pod-net"}, "pod"),
+		Entry("namespace", "default", "plain", []string{"ns-net"}, "namespace"),
+		Entry("cluster default", "other", "lonely", []string{"cluster-net"}, "cluster"),
+	)
+
+	It("should return nothing without a cluster default", func() {
+		netArr, err := k8s.GetPodNet("other", "lonely")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netArr).To(BeEmpty())
+	})
+
+	It("should fail when the pod cannot be found", func() {
+		_, err := k8s.GetPodNet("default", "missing")
+		Expect(err).To(MatchError(ContainSubstring("failed to get pod default/missing")))
+	})
+
+	It("should fall back to the namespace when an owner has been deleted", func() {
+		netArr, source, err := k8s.ResolvePodNet("default", "orphan-abc-1", []string{"cluster-net"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netArr).To(Equal([]string{"ns-net"}))
+		Expect(source).To(Equal(utils.AppNetSourceNamespace))
+	})
+
+	It("should build the sticky key of StatefulSet pods only", func() {
+		key, err := k8s.GetStickyKey("default", "db-0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(Equal("default/db/0"))
+
+		key, err = k8s.GetStickyKey("default", "web-abc-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(BeEmpty())
+	})
+
+	DescribeTable("retains sticky IPs while the ordinal is below replicas",
+		func(key string, expected bool) {
+			retained, err := k8s.StickyRetained(key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retained).To(Equal(expected))
+		},
+		Entry("running ordinal", "default/db/1", true),
+		Entry("scaled down", "default/db/2", false),
+		Entry("deleted statefulset", "default/gone/0", false),
+	)
+})
+
+var _ = Describe("StartInformers", func() {
+	var (
+		k8s    *utils.K8s
+		stopCh chan struct{}
+	)
+
+	BeforeEach(func() {
+		client := fake.NewSimpleClientset(
+			&corev1.Node{ObjectMeta: metaV1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a"}}},
+			&corev1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "default"}},
+			newPod("web-abc-1", nil, ownerRef("apps/v1", "ReplicaSet", "web-abc")),
+			&appsv1.ReplicaSet{ObjectMeta: metaV1.ObjectMeta{
+				Namespace:       "default",
+				Name:            "web-abc",
+				OwnerReferences: []metaV1.OwnerReference{ownerRef("apps/v1", "Deployment", "web")},
+			}},
+			&appsv1.Deployment{ObjectMeta: metaV1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "web",
+				Annotations: map[string]string{"app_net": "net1"},
+			}},
+		)
+		// dynamic client里没有任何控制器，能找到说明读的是informer缓存
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+		k8s = utils.NewK8sForClients(client, dynamicClient, meta.NewDefaultRESTMapper(nil))
+		stopCh = make(chan struct{})
+		Expect(k8s.StartInformers("node1", 0, stopCh)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+	})
+
+	It("should resolve apps/v1 owners and node labels from the cache", func() {
+		netArr, source, err := k8s.ResolvePodNet("default", "web-abc-1", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netArr).To(Equal([]string{"net1"}))
+		Expect(source).To(Equal("Deployment/web"))
+
+		labels, err := k8s.GetNodeLabels("node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(labels).To(Equal(map[string]string{"zone": "a"}))
+	})
+})
+
+var _ = Describe("pod annotations and events", func() {
+	var (
+		client *fake.Clientset
+		k8s    *utils.K8s
+	)
+
+	BeforeEach(func() {
+		pod := newPod("web-1", map[string]string{"app_net": "net1"})
+		pod.UID = "uid-1"
+		client = fake.NewSimpleClientset(pod)
+		k8s = utils.NewK8sForClients(client, nil, meta.NewDefaultRESTMapper(nil))
+	})
+
+	It("should merge the allocation result into the pod annotations", func() {
+		Expect(k8s.AnnotatePod("default", "web-1", map[string]string{
+			utils.IPAnnotation:   "10.0.0.2",
+			utils.VlanAnnotation: "100",
+		})).To(Succeed())
+
+		pod, err := k8s.GetPod("default", "web-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations).To(Equal(map[string]string{
+			"app_net":     "net1",
+			"ts-cni/ip":   "10.0.0.2",
+			"ts-cni/vlan": "100",
+		}))
+	})
+
+	It("should record a warning event on the pod", func() {
+		Expect(k8s.PodEvent("default", "web-1", corev1.EventTypeWarning, "PoolExhausted", "no IP left")).To(Succeed())
+
+		events, err := client.CoreV1().Events("default").List(context.TODO(), metaV1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events.Items).To(HaveLen(1))
+		event := events.Items[0]
+		Expect(event.InvolvedObject.Name).To(Equal("web-1"))
+		Expect(event.InvolvedObject.UID).To(BeEquivalentTo("uid-1"))
+		Expect(event.Type).To(Equal(corev1.EventTypeWarning))
+		Expect(event.Reason).To(Equal("PoolExhausted"))
+		Expect(event.Source.Component).To(Equal("tc-cni"))
+	})
+
+	It("should skip the event when the pod is gone", func() {
+		Expect(k8s.PodEvent("default", "missing", corev1.EventTypeWarning, "PoolExhausted", "no IP left")).To(Succeed())
+		events, err := client.CoreV1().Events("default").List(context.TODO(), metaV1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events.Items).To(BeEmpty())
+	})
+})
+
+var _ = Describe("NodeName", func() {
+	AfterEach(func() {
+		os.Unsetenv(utils.NodeNameEnv)
+	})
+
+	It("should prefer the configured node name over NODE_NAME", func() {
+		os.Setenv(utils.NodeNameEnv, "node-env")
+		Expect(utils.NodeName("node-conf")).To(Equal("node-conf"))
+		Expect(utils.NodeName("")).To(Equal("node-env"))
+	})
+
+	It("should fall back to the lower-cased hostname", func() {
+		os.Unsetenv(utils.NodeNameEnv)
+		hostname, _ := os.Hostname()
+		Expect(utils.NodeName("")).To(Equal(strings.ToLower(hostname)))
+	})
+})
@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	"ts-cni/cni/backend/disk"
+	"ts-cni/cni/structs"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	pluginutils "github.com/containernetworking/plugins/pkg/utils"
+	hostlocal "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultServiceVethIfName  = "eth1"
+	defaultServiceVethSubnet  = "169.254.100.0/22"
+	defaultServiceVethDataDir = "/var/lib/cni/ts-cni/service-veth"
+	// serviceVethPool 节点本地地址池的名字，也是SNAT链名的前缀
+	serviceVethPool = "ts-cni-service"
+)
+
+// ServiceVeth AddServiceVeth创建的veth和pod里加的路由
+type ServiceVeth struct {
+	Host      *current.Interface
+	Container *current.Interface
+	Routes    []*types.Route
+}
+
+// AddServiceVeth 在pod和主机之间建一对veth，pod端从节点本地地址段分配一个/32地址，
+// Service网段和集群pod网段经过主机端的地址路由到主机，主机上SNAT成节点IP后再走kube-proxy的规则
+func AddServiceVeth(conf *structs.ServiceVethConf, containerID string, netns ns.NetNS) (_ *ServiceVeth, err error) {
+	ifName, pool, err := serviceVethPoolOf(conf)
+	if err != nil {
+		return nil, err
+	}
+	store, err := disk.New(serviceVethDataDir(conf), []*allocator.Pool{pool})
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	ipInfo, err := ResIp(store, pool, &backend.Allocation{ContainerID: containerID, IfName: ifName, Timestamp: time.Now()})
+	store.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate node-local IP for %s: %v", ifName, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = store.ReleaseByID(containerID, ifName)
+		}
+	}()
+	podIP := ipInfo.IPAddress
+	gw := pool.Gateway
+	log.Println("service veth pod端地址=", podIP, "主机端地址=", gw)
+
+	var routes []*types.Route
+	for _, cidr := range append(append([]string{}, conf.ServiceCIDRs...), conf.ClusterCIDRs...) {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid serviceVeth CIDR %q: %v", cidr, err)
+		}
+		routes = append(routes, &types.Route{Dst: *dst, GW: gw})
+	}
+
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return nil, err
+	}
+	defer hostNS.Close()
+
+	res := &ServiceVeth{}
+	subnet := pool.IPNet()
+	podNet := &net.IPNet{IP: podIP, Mask: subnet.Mask}
+	masq := false
+	// 回滚在SetupVeth成功后就生效: 删pod端veth时主机端和上面的地址、路由随之删除，
+	// netns里删不掉时直接删主机端；SetupIPMasq可能只加了一半规则，调用过就清理
+	defer func() {
+		if err == nil || res.Host == nil {
+			return
+		}
+		if masq {
+			if e := ip.TeardownIPMasq(podNet, serviceVethChain(containerID), serviceVethComment(containerID)); e != nil {
+				log.Printf("回滚service veth SNAT失败: %v \n", e)
+			}
+		}
+		_ = netns.Do(func(_ ns.NetNS) error {
+			return ip.DelLinkByName(ifName)
+		})
+		if hostLink, e := netlink.LinkByName(res.Host.Name); e == nil {
+			if e := netlink.LinkDel(hostLink); e != nil {
+				log.Printf("回滚service veth主机端 %s 失败: %v \n", res.Host.Name, e)
+			}
+		}
+	}()
+	err = netns.Do(func(_ ns.NetNS) error {
+		hostVeth, contVeth, err := ip.SetupVeth(ifName, 0, hostNS)
+		if err != nil {
+			return err
+		}
+		res.Host = &current.Interface{Name: hostVeth.Name, Mac: hostVeth.HardwareAddr.String()}
+		res.Container = &current.Interface{Name: contVeth.Name, Mac: contVeth.HardwareAddr.String(), Sandbox: netns.Path()}
+
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		addr := &netlink.Addr{IPNet: hostIPNet(podIP)}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("failed to add IP %s to %q: %v", addr.IPNet, ifName, err)
+		}
+		// pod端是/32地址，先加到主机端地址的链路路由，再加经过它的网段路由
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: hostIPNet(gw)}); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", gw, err)
+		}
+		for _, r := range routes {
+			if err := ip.AddRoute(&r.Dst, r.GW, link); err != nil {
+				return fmt.Errorf("failed to add route %s via %s: %v", r.Dst.String(), r.GW, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 主机端: 所有veth共用第一个地址，回pod的/32路由，转发和SNAT
+	hostLink, err := netlink.LinkByName(res.Host.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup host veth %q: %v", res.Host.Name, err)
+	}
+	if err := netlink.AddrAdd(hostLink, &netlink.Addr{IPNet: hostIPNet(gw), Scope: int(netlink.SCOPE_LINK)}); err != nil {
+		return nil, fmt.Errorf("failed to add IP %s to host veth %q: %v", gw, res.Host.Name, err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: hostLink.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: hostIPNet(podIP)}); err != nil {
+		return nil, fmt.Errorf("failed to add host route to %s: %v", podIP, err)
+	}
+	if err := ip.EnableIP4Forward(); err != nil {
+		return nil, fmt.Errorf("failed to enable ip forwarding: %v", err)
+	}
+	masq = true
+	if err := ip.SetupIPMasq(podNet, serviceVethChain(containerID), serviceVethComment(containerID)); err != nil {
+		return nil, fmt.Errorf("failed to setup SNAT for %s: %v", podIP, err)
+	}
+	res.Routes = routes
+	return res, nil
+}
+
+// DelServiceVeth 删除pod端的veth(主机端和路由随之删除)、SNAT规则，并释放节点本地地址
+// netnsPath为空或者netns已经不在时只清理主机上的规则和地址
+func DelServiceVeth(conf *structs.ServiceVethConf, containerID string, netnsPath string) error {
+	ifName, pool, err := serviceVethPoolOf(conf)
+	if err != nil {
+		return err
+	}
+	store, err := disk.New(serviceVethDataDir(conf), []*allocator.Pool{pool})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if netnsPath != "" {
+		err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+			if err := ip.DelLinkByName(ifName); err != nil && err != ip.ErrLinkNotFound {
+				return err
+			}
+			return nil
+		})
+		if _, ok := err.(ns.NSPathNotExistErr); err != nil && !ok {
+			return err
+		}
+	}
+
+	podIPs, err := store.GetByID(containerID, ifName)
+	if err != nil {
+		return err
+	}
+	subnet := pool.IPNet()
+	for _, podIP := range podIPs {
+		if err := ip.TeardownIPMasq(&net.IPNet{IP: podIP, Mask: subnet.Mask}, serviceVethChain(containerID), serviceVethComment(containerID)); err != nil {
+			return fmt.Errorf("failed to teardown SNAT for %s: %v", podIP, err)
+		}
+	}
+	return store.ReleaseByID(containerID, ifName)
+}
+
+// serviceVethPoolOf 按配置生成节点本地地址池，网关就是主机端的地址
+func serviceVethPoolOf(conf *structs.ServiceVethConf) (string, *allocator.Pool, error) {
+	ifName := conf.IfName
+	if ifName == "" {
+		ifName = defaultServiceVethIfName
+	}
+	subnet := conf.Subnet
+	if subnet == "" {
+		subnet = defaultServiceVethSubnet
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return "", nil, fmt.Errorf("invalid serviceVeth subnet %q, must be an IPv4 CIDR", subnet)
+	}
+	pool := &allocator.Pool{
+		Range: hostlocal.Range{Subnet: types.IPNet(*ipNet)},
+		Name:  serviceVethPool,
+	}
+	if err := pool.Canonicalize(); err != nil {
+		return "", nil, fmt.Errorf("invalid serviceVeth subnet %q: %v", subnet, err)
+	}
+	return ifName, pool, nil
+}
+
+func serviceVethDataDir(conf *structs.ServiceVethConf) string {
+	if conf.DataDir != "" {
+		return conf.DataDir
+	}
+	return defaultServiceVethDataDir
+}
+
+func serviceVethChain(containerID string) string {
+	return pluginutils.FormatChainName(serviceVethPool, containerID)
+}
+
+func serviceVethComment(containerID string) string {
+	return pluginutils.FormatComment(serviceVethPool, containerID)
+}
+
+// hostIPNet IPv4的/32
+func hostIPNet(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+}
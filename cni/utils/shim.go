@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// ShimStateDir 记录每个容器网卡在shim上加的主机路由，DEL时按记录删除
+	// 目录结构: <ShimStateDir>/<containerID>-<ifName>
+	ShimStateDir = "/var/lib/cni/ts-cni/shim"
+	// tc-cni创建的shim网卡打上这个alias
+	shimAlias = "ts-cni-shim"
+)
+
+// shimRoutes 一个容器网卡在shim上的主机路由，Src是路由的源地址(shim的地址)
+type shimRoutes struct {
+	Shim string   `json:"shim"`
+	IPs  []net.IP `json:"ips"`
+	Src  []net.IP `json:"src,omitempty"`
+}
+
+// ShimName VLAN子接口上shim网卡的名字，网卡名最长15个字符，超长时用hash
+func ShimName(vlanName string) string {
+	name := "ts-" + vlanName
+	if len(name) <= 15 {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(vlanName))
+	return fmt.Sprintf("ts-%08x", h.Sum32())
+}
+
+// AddShimRoutes 确认VLAN子接口上有bridge模式的macvlan shim并配上shimIPs，
+// 再给pod的每个IP加一条经过shim、源地址是同地址族shim地址的主机路由
+// macvlan子接口和master之间不通，主机(kubelet探针、hostNetwork的pod)通过shim访问pod，
+// pod的回包发给同网段的shim地址，不经过VLAN网关
+func AddShimRoutes(vlanName string, containerID string, ifName string, ips []net.IP, shimIPs []net.IP) error {
+	lock, err := lockVlanState()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	defer lock.Unlock()
+
+	shim, err := ensureShim(vlanName)
+	if err != nil {
+		return err
+	}
+	for _, shimIP := range shimIPs {
+		if err := netlink.AddrReplace(shim, shimAddr(shimIP)); err != nil {
+			return fmt.Errorf("failed to add %s to shim %q: %v", shimIP, shim.Attrs().Name, err)
+		}
+	}
+	state := &shimRoutes{Shim: shim.Attrs().Name, IPs: ips, Src: shimIPs}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ShimStateDir, 0755); err != nil {
+		return err
+	}
+	// 先记录再加路由，加到一半失败时DEL也能删干净
+	if err := ioutil.WriteFile(filepath.Join(ShimStateDir, vlanRefName(containerID, ifName)), data, 0644); err != nil {
+		return fmt.Errorf("failed to record shim routes: %v", err)
+	}
+	for _, ip := range ips {
+		route := hostRoute(shim.Attrs().Index, ip, sameFamily(shimIPs, ip))
+		log.Println("添加到pod的主机路由=", route)
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add host route %s via %s: %v", route.Dst, state.Shim, err)
+		}
+	}
+	return nil
+}
+
+// DelShimRoutes 删除AddShimRoutes加的主机路由，shim网卡随VLAN子接口一起回收
+func DelShimRoutes(containerID string, ifName string) error {
+	lock, err := lockVlanState()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	defer lock.Unlock()
+
+	file := filepath.Join(ShimStateDir, vlanRefName(containerID, ifName))
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &shimRoutes{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("invalid shim routes record %s: %v", file, err)
+	}
+	if shim, err := netlink.LinkByName(state.Shim); err == nil {
+		for _, ip := range state.IPs {
+			route := hostRoute(shim.Attrs().Index, ip, sameFamily(state.Src, ip))
+			log.Println("删除到pod的主机路由=", route)
+			if err := netlink.RouteDel(route); err != nil && err != syscall.ESRCH {
+				return fmt.Errorf("failed to delete host route %s via %s: %v", route.Dst, state.Shim, err)
+			}
+		}
+	}
+	return os.Remove(file)
+}
+
+func ensureShim(vlanName string) (netlink.Link, error) {
+	name := ShimName(vlanName)
+	if link, err := netlink.LinkByName(name); err == nil {
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			if err := netlink.LinkSetUp(link); err != nil {
+				return nil, fmt.Errorf("failed to set %q UP: %v", name, err)
+			}
+		}
+		return link, nil
+	}
+	m, err := netlink.LinkByName(vlanName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup vlan %q: %v", vlanName, err)
+	}
+	shim := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: m.Attrs().Index,
+		},
+		Mode: netlink.MACVLAN_MODE_BRIDGE,
+	}
+	log.Println("创建shim网卡=", name)
+	if err := netlink.LinkAdd(shim); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to create shim %q: %v", name, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refetch shim %q: %v", name, err)
+	}
+	if err := netlink.LinkSetAlias(link, shimAlias); err != nil {
+		return nil, fmt.Errorf("failed to set alias on shim %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set %q UP: %v", name, err)
+	}
+	return link, nil
+}
+
+// NodeIPs 默认路由所在网卡上的全局地址，每个地址族分别找默认路由
+func NodeIPs() ([]net.IP, error) {
+	var ips []net.IP
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			if route.Dst != nil {
+				continue
+			}
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil {
+				return nil, err
+			}
+			addrs, err := netlink.AddrList(link, family)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				if addr.IP.IsGlobalUnicast() {
+					ips = append(ips, addr.IP)
+				}
+			}
+			break
+		}
+	}
+	return ips, nil
+}
+
+// ShimPodRoutes pod里到节点IP的路由，下一跳是同地址族的shim地址，
+// 主机用节点IP访问pod时(例如进程绑定了节点IP)，回包也经过shim回到主机
+func ShimPodRoutes(nodeIPs []net.IP, shimIPs []net.IP) []*types.Route {
+	var routes []*types.Route
+	for _, nodeIP := range nodeIPs {
+		gw := sameFamily(shimIPs, nodeIP)
+		if gw == nil {
+			continue
+		}
+		routes = append(routes, &types.Route{Dst: *hostNet(nodeIP), GW: gw})
+	}
+	return routes
+}
+
+// hostRoute 经过shim到pod IP的/32或/128路由，源地址是shim的地址
+func hostRoute(linkIndex int, ip net.IP, src net.IP) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       hostNet(ip),
+		Src:       src,
+	}
+}
+
+// shimAddr shim上的地址只用/32或/128，不生成整个网段的路由，IPv6不做DAD
+func shimAddr(ip net.IP) *netlink.Addr {
+	addr := &netlink.Addr{IPNet: hostNet(ip)}
+	if ip.To4() == nil {
+		addr.Flags = syscall.IFA_F_NODAD
+	}
+	return addr
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	bits := 128
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// sameFamily ips中和ip地址族相同的第一个地址
+func sameFamily(ips []net.IP, ip net.IP) net.IP {
+	for _, v := range ips {
+		if (v.To4() == nil) == (ip.To4() == nil) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package utils_test
+
+import (
+	"net"
+
+	"ts-cni/cni/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ShimName", func() {
+	It("should prefix the vlan name and fit in an interface name", func() {
+		Expect(utils.ShimName("eth0.100")).To(Equal("ts-eth0.100"))
+
+		long := utils.ShimName("enp175s0f1.4094")
+		Expect(len(long)).To(BeNumerically("<=", 15))
+		Expect(long).To(HavePrefix("ts-"))
+		Expect(utils.ShimName("enp175s0f1.4094")).To(Equal(long))
+		Expect(utils.ShimName("enp175s0f1.4093")).NotTo(Equal(long))
+	})
+})
+
+var _ = Describe("ShimPodRoutes", func() {
+	It("should route each node IP via the shim address of the same family", func() {
+		nodeIPs := []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("fd00:1::10")}
+		routes := utils.ShimPodRoutes(nodeIPs, []net.IP{net.ParseIP("10.1.0.2").To4()})
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Dst.String()).To(Equal("192.168.1.10/32"))
+		Expect(routes[0].GW.String()).To(Equal("10.1.0.2"))
+	})
+})
@@ -1,33 +1,551 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"strings"
+	"net"
+	"time"
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
 	"ts-cni/cni/structs"
 )
 
-var dIpRange = MakeRange(11, 30)
-
-// ResIp 分配IP，返回IP
-func ResIp(etcdClient *EtcdClient, NetInfo *structs.NetInfo) {
-	// 获取ip前缀
-	abcIpRange := NetInfo.AppNet[:strings.LastIndex(NetInfo.AppNet, ".")]
-	var ipAllList []string
-	for i := 0; i < len(dIpRange)-1; i++ {
-		// 该网段IP总列表
-		ipAllList = append(ipAllList, abcIpRange+"."+string(rune(dIpRange[i])))
-	}
-	// 根据已使用的和总列表取出差集
-	diffIpList := Difference(NetInfo.UseIpList, ipAllList)
-	resIp := diffIpList[0]
-	resGw := abcIpRange + ".254"
-	err := etcdClient.Lock("/ipam/" + NetInfo.AppNet + "/" + resIp)
-	if err != nil {
-		log.Println("加锁失败, err=", err)
-		NetInfo.IPAddress = ""
-		NetInfo.GateWay = ""
-	} else {
-		NetInfo.IPAddress = resIp
-		NetInfo.GateWay = resGw
+// 分配失败的原因，调用方用errors.Is判断后给pod发Event
+var (
+	// ErrPoolNotFound app_net中的地址池都找不到
+	ErrPoolNotFound = errors.New("app_net pool not found")
+	// ErrPoolExhausted app_net中的地址池都没有可用的IP了
+	ErrPoolExhausted = errors.New("app_net pool exhausted")
+	// ErrIPUnavailable 指定的IP不能分配
+	ErrIPUnavailable = errors.New("requested IP unavailable")
+)
+
+// ResIp 从地址池中分配IP，被别人抢走了就换下一个，直到地址池用完
+func ResIp(store backend.Store, pool *allocator.Pool, alloc *backend.Allocation) (structs.IPInfo, error) {
+	usedIps, err := store.Reserved(pool.Name)
+	if err != nil {
+		return structs.IPInfo{}, err
+	}
+	ipAllocator := allocator.NewIPAllocator(pool)
+	for {
+		resIp, err := ipAllocator.Get(usedIps)
+		if err != nil {
+			return structs.IPInfo{}, err
+		}
+		reserved, err := store.Reserve(alloc, resIp, pool.Name)
+		if err != nil {
+			return structs.IPInfo{}, fmt.Errorf("failed to reserve %s in pool %s: %v", resIp, pool.Name, err)
+		}
+		if reserved {
+			return newIPInfo(pool, resIp), nil
+		}
+		log.Printf("IPAM %v 已经被占用了, 换下一个 \n", resIp)
+		// 被别人抢走了，记到已使用列表里，下次跳过
+		usedIps = append(usedIps, resIp)
+	}
+}
+
+// IpamAdd 按app_net的顺序从地址池中分配IP，alloc是写到分配记录里的pod信息
+func IpamAdd(store backend.Store, netArr []string, alloc *backend.Allocation) (structs.NetInfo, error) {
+	// 根据Annotations中的app_net
+	// 第一步 查询app_net是否在存储的所有地址池中存在
+	// 第二步 如果存在，按地址池的网段/range/exclude算出空闲的IP
+	// 第三步 如果没有空闲IP，就取app_net中下一个网段，如果没有下一个网段，报地址池IP不够
+	// 第四步 抢到IP后，返回当前网段的vlanID，由调用方拼接到master上
+	if err := store.Lock(); err != nil {
+		return structs.NetInfo{}, err
+	}
+	defer store.Unlock()
+
+	// 同一个容器网卡不允许重复分配
+	// https://github.com/containernetworking/cni/blob/master/SPEC.md
+	allocatedIps, err := store.GetByID(alloc.ContainerID, alloc.IfName)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	if len(allocatedIps) > 0 {
+		return structs.NetInfo{}, fmt.Errorf("%v has been allocated to %s, duplicate allocation is not allowed", allocatedIps, alloc.ContainerID)
+	}
+
+	pools, err := poolMap(store)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	// StatefulSet的pod优先拿回之前保留的IP
+	if alloc.Retained() {
+		netInfo, err := rebindSticky(store, pools, netArr, alloc)
+		if err != nil {
+			return structs.NetInfo{}, err
+		}
+		if len(netInfo.IPs) > 0 {
+			log.Println("IPAM 拿回保留的IP信息=", netInfo)
+			return netInfo, nil
+		}
+	}
+	log.Println("容器yaml配置文件中注解的网段=", netArr)
+	found := false
+	for _, v := range netArr {
+		pool, ok := pools[v]
+		if !ok {
+			log.Printf("Annotations里的app_net %v 写的有问题，找不到! \n", v)
+			continue
+		}
+		found = true
+		resNetInfo, err := resNet(store, pools, pool, alloc)
+		if errors.Is(err, allocator.ErrExhausted) {
+			log.Printf("%v 这个IP地址段中已经没有IP了! err=%v \n", v, err)
+			continue
+		}
+		// 存储出错(例如etcd超时)或地址池配置有问题，不能当成地址池不够
+		if err != nil {
+			return structs.NetInfo{}, err
+		}
+		log.Println("IPAM 分配完的IP信息=", resNetInfo)
+		return resNetInfo, nil
+	}
+	if !found {
+		return structs.NetInfo{}, fmt.Errorf("%w: Annotations里的app_net %v 找不到!", ErrPoolNotFound, netArr)
+	}
+	return structs.NetInfo{}, fmt.Errorf("%w: Annotations里的app_net %v 地址池不够了!", ErrPoolExhausted, netArr)
+}
+
+// IpamAddStatic 分配pod指定的IP，IP必须在app_net的地址池(或者它们配对的地址池)中
+// 和host-local的requestedIP一样，IP已经被占用时直接报错，不会换一个IP
+// 双栈地址池只指定了一个地址族时，另一个地址族从配对的地址池自动分配
+func IpamAddStatic(store backend.Store, netArr []string, alloc *backend.Allocation, requested []net.IP) (structs.NetInfo, error) {
+	// 每个地址族最多一个IP
+	if len(requested) > 2 {
+		return structs.NetInfo{}, fmt.Errorf("%w: at most one IPv4 and one IPv6 can be requested, got %v", ErrIPUnavailable, requested)
+	}
+	if err := store.Lock(); err != nil {
+		return structs.NetInfo{}, err
+	}
+	defer store.Unlock()
+
+	allocatedIps, err := store.GetByID(alloc.ContainerID, alloc.IfName)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	if len(allocatedIps) > 0 {
+		return structs.NetInfo{}, fmt.Errorf("%v has been allocated to %s, duplicate allocation is not allowed", allocatedIps, alloc.ContainerID)
+	}
+
+	pools, err := poolMap(store)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	var allowed []*allocator.Pool
+	for _, v := range netArr {
+		if pool, ok := pools[v]; ok {
+			allowed = append(allowed, pool)
+			if pair, ok := pools[pool.Pair]; ok {
+				allowed = append(allowed, pair)
+			}
+		}
+	}
+
+	var netInfo structs.NetInfo
+	var claimed []*allocator.Pool
+	// 失败时把已经占用的IP还回去
+	release := func() {
+		for i, pool := range claimed {
+			_ = releaseReserved(store, alloc, netInfo.IPs[i].IPAddress, pool.Name)
+		}
+	}
+	for _, ip := range requested {
+		pool := poolContaining(allowed, ip)
+		if pool == nil {
+			release()
+			return structs.NetInfo{}, fmt.Errorf("%w: requested IP %s is not in any pool of app_net %v", ErrIPUnavailable, ip, netArr)
+		}
+		if !pool.Allocatable(ip) {
+			release()
+			return structs.NetInfo{}, fmt.Errorf("%w: requested IP %s is not available in pool %s", ErrIPUnavailable, ip, pool.String())
+		}
+		if netInfo.AppNet == "" {
+			netInfo = newNetInfo(pool)
+		} else if sameFamilyClaimed(claimed, pool) {
+			release()
+			return structs.NetInfo{}, fmt.Errorf("requested IP %s: only one IP per address family is allowed", ip)
+		} else if netInfo.VlanId != pool.VlanId {
+			release()
+			return structs.NetInfo{}, fmt.Errorf("requested IP %s is in vlan %s, others are in vlan %s", ip, pool.VlanId, netInfo.VlanId)
+		}
+		reserved, err := store.Reserve(alloc, ip, pool.Name)
+		if err != nil {
+			release()
+			return structs.NetInfo{}, fmt.Errorf("failed to reserve %s in pool %s: %v", ip, pool.Name, err)
+		}
+		if !reserved {
+			release()
+			return structs.NetInfo{}, fmt.Errorf("%w: requested IP %s has been allocated in pool %s", ErrIPUnavailable, ip, pool.Name)
+		}
+		claimed = append(claimed, pool)
+		netInfo.IPs = append(netInfo.IPs, newIPInfo(pool, ip))
+	}
+
+	if len(claimed) == 1 {
+		if pair := pairOf(pools, claimed[0]); pair != nil {
+			pairInfo, err := ResIp(store, pair, alloc)
+			if err != nil {
+				release()
+				return structs.NetInfo{}, err
+			}
+			netInfo.IPs = append(netInfo.IPs, pairInfo)
+		}
+	}
+	log.Println("IPAM 分配指定的IP信息=", netInfo)
+	return netInfo, nil
+}
+
+// IpamCheck 找到pod每个IP所属的地址池，并确认分配记录还在而且属于这个容器网卡
+func IpamCheck(store backend.Store, podIps []net.IP, id string, ifname string) (structs.NetInfo, error) {
+	if err := store.Lock(); err != nil {
+		return structs.NetInfo{}, err
+	}
+	defer store.Unlock()
+
+	var netInfo structs.NetInfo
+	allocatedIps, err := store.GetByID(id, ifname)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	for _, podIp := range podIps {
+		pool, err := poolFor(store, podIp)
+		if err != nil {
+			return structs.NetInfo{}, err
+		}
+		if !containsIP(allocatedIps, podIp) {
+			return structs.NetInfo{}, fmt.Errorf("IP %s 在地址池 %s 中没有 %s/%s 的分配记录", podIp, pool.Name, id, ifname)
+		}
+		if netInfo.AppNet == "" {
+			netInfo = newNetInfo(pool)
+		} else if netInfo.VlanId != pool.VlanId {
+			return structs.NetInfo{}, fmt.Errorf("IP %s 所在地址池 %s 的VLAN %s 和 %s 不一样", podIp, pool.Name, pool.VlanId, netInfo.VlanId)
+		}
+		netInfo.IPs = append(netInfo.IPs, newIPInfo(pool, podIp))
+	}
+	return netInfo, nil
+}
+
+// IpamDel 释放这个容器网卡的所有分配记录，DEL可能被调用多次，没有记录也不报错
+func IpamDel(store backend.Store, id string, ifname string) error {
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	ips, err := store.GetByID(id, ifname)
+	if err != nil {
+		return err
+	}
+	log.Println("IPAM 释放IP=", ips)
+	return store.ReleaseByID(id, ifname)
+}
+
+// StickyKeys 返回这个容器网卡的分配记录中的Sticky，DEL之前用来判断要不要真正释放
+func StickyKeys(store backend.Store, id string, ifname string) ([]string, error) {
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+	records, err := store.Records()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, r := range records {
+		if r.Allocation.Owns(id, ifname) && r.Allocation.Retained() && !IsExistString(r.Allocation.Sticky, keys) {
+			keys = append(keys, r.Allocation.Sticky)
+		}
+	}
+	return keys, nil
+}
+
+// IpamReleaseSticky 释放保留给key的所有IP，StatefulSet缩容或删除后调用
+func IpamReleaseSticky(store backend.Store, key string) error {
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	records, err := store.Records()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Allocation.Sticky != key {
+			continue
+		}
+		released, err := store.Release(r)
+		if err != nil {
+			return err
+		}
+		if !released {
+			// 同时有pod拿回了这个IP
+			log.Printf("IPAM 保留给 %s 的IP %v 已经变了, 不释放 \n", key, r.IP)
+			continue
+		}
+		log.Printf("IPAM 释放保留给 %s 的IP %v \n", key, r.IP)
+	}
+	return nil
+}
+
+// IpamConflict 把容器网卡分配到、但DAD发现已经被别人占用的IP改成冲突记录，
+// 之后释放这个容器网卡时这些IP不会回到地址池，重新分配时会拿到别的IP
+func IpamConflict(store backend.Store, id string, ifname string, ips []net.IP, reason string) error {
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	records, err := store.Records()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if !r.Allocation.Owns(id, ifname) || !containsIP(ips, r.IP) {
+			continue
+		}
+		updated, err := store.Update(r, r.Allocation.MarkConflict(reason))
+		if err != nil {
+			return err
+		}
+		if !updated {
+			log.Printf("IPAM 分配记录 %s/%v 已经变了, 不标记冲突 \n", r.Pool, r.IP)
+			continue
+		}
+		log.Printf("IPAM IP %s/%v 和网络里的主机冲突, 保留不再分配: %s \n", r.Pool, r.IP, reason)
+	}
+	return nil
+}
+
+// ShimContainerID 节点shim地址的分配记录用的ContainerID，IfName是地址池名字
+// 记录里没有pod信息，节点删除以后由GC回收
+func ShimContainerID(node string) string {
+	return "ts-cni-shim-" + node
+}
+
+// IpamShim 返回节点在netInfo每个IP所在地址池中的shim地址，每个节点每个地址池一个，
+// 第一次使用时从地址池分配，之后一直保留给这个节点
+func IpamShim(store backend.Store, node string, netInfo structs.NetInfo) ([]structs.IPInfo, error) {
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+
+	pools, err := poolMap(store)
+	if err != nil {
+		return nil, err
+	}
+	var shimIPs []structs.IPInfo
+	for _, ipInfo := range netInfo.IPs {
+		pool, ok := pools[ipInfo.AppNet]
+		if !ok {
+			return nil, fmt.Errorf("%w: pool %s", ErrPoolNotFound, ipInfo.AppNet)
+		}
+		alloc := &backend.Allocation{
+			ContainerID: ShimContainerID(node),
+			IfName:      pool.Name,
+			Node:        node,
+			Timestamp:   time.Now(),
+		}
+		ips, err := store.GetByID(alloc.ContainerID, alloc.IfName)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 {
+			shimIPs = append(shimIPs, newIPInfo(pool, ips[0]))
+			continue
+		}
+		shimIP, err := ResIp(store, pool, alloc)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("IPAM 给节点 %s 的shim分配IP %v \n", node, shimIP.IPAddress)
+		shimIPs = append(shimIPs, shimIP)
+	}
+	return shimIPs, nil
+}
+
+// rebindSticky 把保留给alloc.Sticky的IP交给新的容器网卡，没有保留的IP时返回空的NetInfo
+// app_net改过以后，不在netArr的地址池(或者它们配对的地址池)里的保留IP会被释放，由调用方重新分配
+func rebindSticky(store backend.Store, pools map[string]*allocator.Pool, netArr []string, alloc *backend.Allocation) (structs.NetInfo, error) {
+	allowed := map[string]bool{}
+	for _, v := range netArr {
+		if pool, ok := pools[v]; ok {
+			allowed[pool.Name] = true
+			if pair := pairOf(pools, pool); pair != nil {
+				allowed[pair.Name] = true
+			}
+		}
+	}
+	records, err := store.Records()
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	var netInfo structs.NetInfo
+	for _, r := range records {
+		if r.Allocation.Sticky != alloc.Sticky {
+			continue
+		}
+		pool, ok := pools[r.Pool]
+		if !ok || !allowed[r.Pool] {
+			log.Printf("IPAM 保留的IP %v 所在地址池 %s 不在app_net %v 中，释放后重新分配 \n", r.IP, r.Pool, netArr)
+			if _, err := store.Release(r); err != nil {
+				return structs.NetInfo{}, err
+			}
+			continue
+		}
+		rebound, err := store.Rebind(alloc, r.IP, r.Pool)
+		if err != nil {
+			return structs.NetInfo{}, err
+		}
+		if !rebound {
+			return structs.NetInfo{}, fmt.Errorf("保留给 %s 的IP %v 被同时修改了", alloc.Sticky, r.IP)
+		}
+		if netInfo.AppNet == "" {
+			netInfo = newNetInfo(pool)
+		}
+		netInfo.IPs = append(netInfo.IPs, newIPInfo(pool, r.IP))
+	}
+	return netInfo, nil
+}
+
+// resNet 从地址池中分配IP，地址池配置了pair时再从配对的地址池分配另一个地址族的IP
+func resNet(store backend.Store, pools map[string]*allocator.Pool, pool *allocator.Pool, alloc *backend.Allocation) (structs.NetInfo, error) {
+	var pairPool *allocator.Pool
+	if pool.Pair != "" {
+		var ok bool
+		if pairPool, ok = pools[pool.Pair]; !ok {
+			return structs.NetInfo{}, fmt.Errorf("pool %s 配对的地址池 %s 找不到", pool.Name, pool.Pair)
+		}
+		if err := pool.CheckPair(pairPool); err != nil {
+			return structs.NetInfo{}, err
+		}
+	}
+
+	ipInfo, err := ResIp(store, pool, alloc)
+	if err != nil {
+		return structs.NetInfo{}, err
+	}
+	netInfo := newNetInfo(pool)
+	netInfo.IPs = []structs.IPInfo{ipInfo}
+	if pairPool == nil {
+		return netInfo, nil
+	}
+
+	pairInfo, err := ResIp(store, pairPool, alloc)
+	if err != nil {
+		// 另一个地址族分配失败，把已经分配的IP还回去
+		_ = releaseReserved(store, alloc, ipInfo.IPAddress, pool.Name)
+		return structs.NetInfo{}, err
+	}
+	netInfo.IPs = append(netInfo.IPs, pairInfo)
+	return netInfo, nil
+}
+
+// sameFamilyClaimed 已经占用的地址池里有没有和pool同一个地址族的
+func sameFamilyClaimed(claimed []*allocator.Pool, pool *allocator.Pool) bool {
+	for _, p := range claimed {
+		if p.IsIPv6() == pool.IsIPv6() {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseReserved 分配失败时还回刚刚给alloc占用的IP，记录已经不属于alloc时不动
+func releaseReserved(store backend.Store, alloc *backend.Allocation, ip net.IP, pool string) error {
+	records, err := store.Records()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Pool == pool && r.IP.Equal(ip) && r.Allocation.Owns(alloc.ContainerID, alloc.IfName) {
+			_, err := store.Release(r)
+			return err
+		}
+	}
+	return nil
+}
+
+// newNetInfo 地址池所在VLAN的信息，IP由调用方添加
+func newNetInfo(pool *allocator.Pool) structs.NetInfo {
+	return structs.NetInfo{
+		VlanId:    pool.VlanId,
+		AppNet:    pool.Name,
+		Master:    pool.Master,
+		MTU:       pool.MTU,
+		Mode:      pool.Mode,
+		MacPrefix: pool.MacPrefix,
+	}
+}
+
+func newIPInfo(pool *allocator.Pool, ip net.IP) structs.IPInfo {
+	// 存储中解析出来的IPv4是16字节的，统一成4字节
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return structs.IPInfo{
+		AppNet:    pool.Name,
+		IPAddress: ip,
+		Subnet:    *pool.IPNet(),
+		GateWay:   pool.Gateway,
+	}
+}
+
+// pairOf 双栈时和pool配对的另一个地址池，两个方向的pair都算
+func pairOf(pools map[string]*allocator.Pool, pool *allocator.Pool) *allocator.Pool {
+	if pair, ok := pools[pool.Pair]; ok && pool.CheckPair(pair) == nil {
+		return pair
+	}
+	for _, p := range pools {
+		if p.Pair == pool.Name && pool.CheckPair(p) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func poolContaining(pools []*allocator.Pool, ip net.IP) *allocator.Pool {
+	for _, p := range pools {
+		if p.IPNet().Contains(ip) {
+			return p
+		}
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func poolMap(store backend.Store) (map[string]*allocator.Pool, error) {
+	pools, err := store.Pools()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]*allocator.Pool, len(pools))
+	for _, p := range pools {
+		m[p.Name] = p
+	}
+	return m, nil
+}
+
+// poolFor 找到包含ip的地址池
+func poolFor(store backend.Store, ip net.IP) (*allocator.Pool, error) {
+	pools, err := store.Pools()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pools {
+		if p.Contains(ip) {
+			return p, nil
+		}
 	}
+	return nil, fmt.Errorf("IP %s 不属于任何一个地址池", ip)
 }
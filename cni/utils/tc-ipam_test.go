@@ -0,0 +1,324 @@
+package utils_test
+
+import (
+	"errors"
+	"net"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	fakestore "ts-cni/cni/backend/testing"
+	"ts-cni/cni/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func mustLoadPool(name string, value string) *allocator.Pool {
+	p, err := allocator.LoadPool(name, value)
+	Expect(err).NotTo(HaveOccurred())
+	return p
+}
+
+func newAllocation(id string) *backend.Allocation {
+	return &backend.Allocation{ContainerID: id, IfName: "eth0", PodNamespace: "default", PodName: id}
+}
+
+// failingStore 读分配记录时返回错误，模拟etcd超时
+type failingStore struct {
+	*fakestore.FakeStore
+}
+
+func (s failingStore) Reserved(pool string) ([]net.IP, error) {
+	return nil, errors.New("context deadline exceeded")
+}
+
+// unreadableStore 查容器网卡的分配记录时返回错误
+type unreadableStore struct {
+	*fakestore.FakeStore
+}
+
+func (s unreadableStore) GetByID(id string, ifname string) ([]net.IP, error) {
+	return nil, errors.New("etcdserver: request timed out")
+}
+
+var _ = Describe("tc-cni IPAM", func() {
+	var store *fakestore.FakeStore
+
+	BeforeEach(func() {
+		store = fakestore.NewFakeStore([]*allocator.Pool{
+			mustLoadPool("small", `{"subnet":"10.0.0.0/30","vlan":"100"}`),
+			mustLoadPool("big", `{"subnet":"10.1.0.0/24","gateway":"10.1.0.254","vlan":"200"}`),
+		})
+	})
+
+	It("should allocate from the first pool listed in app_net", func() {
+		info, err := utils.IpamAdd(store, []string{"small", "big"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.AppNet).To(Equal("small"))
+		Expect(info.VlanId).To(Equal("100"))
+		Expect(info.IPs).To(HaveLen(1))
+		Expect(info.IPs[0].IPAddress.String()).To(Equal("10.0.0.2"))
+		Expect(info.IPs[0].GateWay.String()).To(Equal("10.0.0.1"))
+		Expect(store.GetByID("c1", "eth0")).To(HaveLen(1))
+	})
+
+	It("should fall through to the next pool when one is exhausted", func() {
+		_, err := utils.IpamAdd(store, []string{"small"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+
+		info, err := utils.IpamAdd(store, []string{"missing", "small", "big"}, newAllocation("c2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.AppNet).To(Equal("big"))
+		Expect(info.IPs[0].IPAddress.String()).To(Equal("10.1.0.1"))
+		Expect(info.IPs[0].Subnet.Mask).To(Equal(net.CIDRMask(24, 32)))
+	})
+
+	It("should fail when no listed pool has addresses", func() {
+		_, err := utils.IpamAdd(store, []string{"small"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = utils.IpamAdd(store, []string{"small", "missing"}, newAllocation("c2"))
+		Expect(errors.Is(err, utils.ErrPoolExhausted)).To(BeTrue())
+		_, err = utils.IpamAdd(store, []string{"missing"}, newAllocation("c2"))
+		Expect(errors.Is(err, utils.ErrPoolNotFound)).To(BeTrue())
+	})
+
+	It("should return store errors instead of reporting the pool exhausted", func() {
+		_, err := utils.IpamAdd(failingStore{store}, []string{"small", "big"}, newAllocation("c1"))
+		Expect(err).To(MatchError(ContainSubstring("context deadline exceeded")))
+		Expect(errors.Is(err, utils.ErrPoolExhausted)).To(BeFalse())
+	})
+
+	It("should not skip the duplicate check when the store cannot be read", func() {
+		info, err := utils.IpamAdd(store, []string{"big"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = utils.IpamAdd(unreadableStore{store}, []string{"big"}, newAllocation("c1"))
+		Expect(err).To(MatchError(ContainSubstring("request timed out")))
+		_, err = utils.IpamCheck(unreadableStore{store}, []net.IP{info.IPs[0].IPAddress}, "c1", "eth0")
+		Expect(err).To(MatchError(ContainSubstring("request timed out")))
+		Expect(store.GetByID("c1", "eth0")).To(HaveLen(1))
+	})
+
+	It("should find the pool and allocation record on check", func() {
+		info, err := utils.IpamAdd(store, []string{"big"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+
+		podIps := []net.IP{info.IPs[0].IPAddress}
+		checked, err := utils.IpamCheck(store, podIps, "c1", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checked.VlanId).To(Equal("200"))
+
+		_, err = utils.IpamCheck(store, podIps, "c2", "eth0")
+		Expect(err).To(HaveOccurred())
+
+		Expect(utils.IpamDel(store, "c1", "eth0")).To(Succeed())
+		_, err = utils.IpamCheck(store, podIps, "c1", "eth0")
+		Expect(err).To(MatchError(ContainSubstring("分配记录")))
+	})
+
+	It("should reject a second allocation for the same container interface", func() {
+		_, err := utils.IpamAdd(store, []string{"big"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = utils.IpamAdd(store, []string{"big"}, newAllocation("c1"))
+		Expect(err).To(MatchError(ContainSubstring("duplicate allocation")))
+	})
+	Context("dual-stack pools", func() {
+		BeforeEach(func() {
+			store = fakestore.NewFakeStore([]*allocator.Pool{
+				mustLoadPool("v4", `{"subnet":"10.2.0.0/30","vlan":"300","pair":"v6"}`),
+				mustLoadPool("v6", `{"subnet":"fd00:300::/120","vlan":"300"}`),
+				mustLoadPool("v6-full", `{"subnet":"fd00:301::/126","rangeStart":"fd00:301::2","rangeEnd":"fd00:301::2","vlan":"301"}`),
+				mustLoadPool("v4-full", `{"subnet":"10.3.0.0/24","vlan":"301","pair":"v6-full"}`),
+				mustLoadPool("bad-pair", `{"subnet":"10.4.0.0/24","vlan":"400","pair":"v6"}`),
+			})
+		})
+
+		It("should allocate one IPv4 and one IPv6 address on the same vlan", func() {
+			info, err := utils.IpamAdd(store, []string{"v4"}, newAllocation("c1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.VlanId).To(Equal("300"))
+			Expect(info.IPs).To(HaveLen(2))
+			Expect(info.IPs[0].IPAddress.String()).To(Equal("10.2.0.2"))
+			Expect(info.IPs[1].IPAddress.String()).To(Equal("fd00:300::2"))
+			Expect(info.IPs[1].GateWay.String()).To(Equal("fd00:300::1"))
+
+			checked, err := utils.IpamCheck(store, []net.IP{info.IPs[0].IPAddress, info.IPs[1].IPAddress}, "c1", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(checked.IPs).To(HaveLen(2))
+		})
+
+		It("should release the IPv4 address when the paired pool is exhausted", func() {
+			_, err := utils.IpamAdd(store, []string{"v4-full"}, newAllocation("c1"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = utils.IpamAdd(store, []string{"v4-full"}, newAllocation("c2"))
+			Expect(err).To(HaveOccurred())
+			Expect(store.GetByID("c2", "eth0")).To(BeEmpty())
+		})
+
+		It("should reject a pair on a different vlan", func() {
+			_, err := utils.IpamAdd(store, []string{"bad-pair"}, newAllocation("c1"))
+			Expect(err).To(HaveOccurred())
+			Expect(store.GetByID("c1", "eth0")).To(BeEmpty())
+		})
+	})
+
+	Context("sticky allocations", func() {
+		newStickyAllocation := func(id string) *backend.Allocation {
+			alloc := newAllocation(id)
+			alloc.Sticky = backend.StickyKey("default", "db", 0)
+			return alloc
+		}
+
+		It("should keep the IP after delete and give it back to the same ordinal", func() {
+			info, err := utils.IpamAdd(store, []string{"big"}, newStickyAllocation("c1"))
+			Expect(err).NotTo(HaveOccurred())
+			ip := info.IPs[0].IPAddress
+
+			keys, err := utils.StickyKeys(store, "c1", "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(Equal([]string{"default/db/0"}))
+			Expect(utils.IpamDel(store, "c1", "eth0")).To(Succeed())
+			Expect(store.GetByID("c1", "eth0")).To(BeEmpty())
+
+			other, err := utils.IpamAdd(store, []string{"big"}, newAllocation("c2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.IPs[0].IPAddress).NotTo(Equal(ip))
+
+			again, err := utils.IpamAdd(store, []string{"big"}, newStickyAllocation("c3"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again.IPs[0].IPAddress).To(Equal(ip))
+			Expect(again.VlanId).To(Equal("200"))
+			Expect(store.GetByID("c3", "eth0")).To(HaveLen(1))
+		})
+
+		It("should free the IP when the sticky key is released", func() {
+			info, err := utils.IpamAdd(store, []string{"small"}, newStickyAllocation("c1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.IpamDel(store, "c1", "eth0")).To(Succeed())
+			_, err = utils.IpamAdd(store, []string{"small"}, newAllocation("c2"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(utils.IpamReleaseSticky(store, "default/db/0")).To(Succeed())
+			reused, err := utils.IpamAdd(store, []string{"small"}, newAllocation("c2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reused.IPs[0].IPAddress).To(Equal(info.IPs[0].IPAddress))
+		})
+
+		It("should not release a kept IP that was rebound after it was read", func() {
+			_, err := utils.IpamAdd(store, []string{"big"}, newStickyAllocation("c1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.IpamDel(store, "c1", "eth0")).To(Succeed())
+			stale, err := store.Records()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stale).To(HaveLen(1))
+
+			_, err = utils.IpamAdd(store, []string{"big"}, newStickyAllocation("c2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Release(stale[0])).To(BeFalse())
+			Expect(store.GetByID("c2", "eth0")).To(HaveLen(1))
+		})
+
+		It("should release the kept IP when app_net no longer lists its pool", func() {
+			info, err := utils.IpamAdd(store, []string{"small"}, newStickyAllocation("c1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.IpamDel(store, "c1", "eth0")).To(Succeed())
+
+			moved, err := utils.IpamAdd(store, []string{"big"}, newStickyAllocation("c2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(moved.AppNet).To(Equal("big"))
+			Expect(moved.VlanId).To(Equal("200"))
+			Expect(store.GetByID("c2", "eth0")).To(HaveLen(1))
+
+			reused, err := utils.IpamAdd(store, []string{"small"}, newAllocation("c3"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reused.IPs[0].IPAddress).To(Equal(info.IPs[0].IPAddress))
+		})
+	})
+
+	Context("static IPs", func() {
+		It("should claim the requested IP from an app_net pool", func() {
+			info, err := utils.IpamAddStatic(store, []string{"small", "big"}, newAllocation("c1"), []net.IP{net.ParseIP("10.1.0.100")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.AppNet).To(Equal("big"))
+			Expect(info.VlanId).To(Equal("200"))
+			Expect(info.IPs[0].IPAddress.String()).To(Equal("10.1.0.100"))
+			Expect(store.GetByID("c1", "eth0")).To(HaveLen(1))
+		})
+
+		It("should fail cleanly when the requested IP is taken", func() {
+			_, err := utils.IpamAddStatic(store, []string{"big"}, newAllocation("c1"), []net.IP{net.ParseIP("10.1.0.100")})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = utils.IpamAddStatic(store, []string{"big"}, newAllocation("c2"), []net.IP{net.ParseIP("10.1.0.100")})
+			Expect(err).To(MatchError(ContainSubstring("has been allocated")))
+			Expect(errors.Is(err, utils.ErrIPUnavailable)).To(BeTrue())
+			Expect(store.GetByID("c2", "eth0")).To(BeEmpty())
+		})
+
+		It("should reject IPs outside the app_net pools or not allocatable", func() {
+			_, err := utils.IpamAddStatic(store, []string{"small"}, newAllocation("c1"), []net.IP{net.ParseIP("10.1.0.100")})
+			Expect(err).To(MatchError(ContainSubstring("not in any pool")))
+			_, err = utils.IpamAddStatic(store, []string{"big"}, newAllocation("c1"), []net.IP{net.ParseIP("10.1.0.254")})
+			Expect(err).To(MatchError(ContainSubstring("not available")))
+		})
+
+		It("should allocate the other family from the paired pool", func() {
+			store = fakestore.NewFakeStore([]*allocator.Pool{
+				mustLoadPool("v4", `{"subnet":"10.2.0.0/24","vlan":"300","pair":"v6"}`),
+				mustLoadPool("v6", `{"subnet":"fd00:300::/120","vlan":"300"}`),
+			})
+			info, err := utils.IpamAddStatic(store, []string{"v4"}, newAllocation("c1"), []net.IP{net.ParseIP("10.2.0.9")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IPs).To(HaveLen(2))
+			Expect(info.IPs[1].IPAddress.String()).To(Equal("fd00:300::2"))
+
+			_, err = utils.IpamAddStatic(store, []string{"v4"}, newAllocation("c2"), []net.IP{net.ParseIP("10.2.0.10"), net.ParseIP("fd00:300::2")})
+			Expect(err).To(HaveOccurred())
+			Expect(store.GetByID("c2", "eth0")).To(BeEmpty())
+		})
+
+		It("should accept at most one IP per address family", func() {
+			store = fakestore.NewFakeStore([]*allocator.Pool{
+				mustLoadPool("v4", `{"subnet":"10.2.0.0/24","vlan":"300","pair":"v6"}`),
+				mustLoadPool("v6", `{"subnet":"fd00:300::/120","vlan":"300"}`),
+			})
+			_, err := utils.IpamAddStatic(store, []string{"v4"}, newAllocation("c1"),
+				[]net.IP{net.ParseIP("10.2.0.5"), net.ParseIP("fd00:300::5"), net.ParseIP("fd00:300::6")})
+			Expect(err).To(MatchError(ContainSubstring("at most one IPv4 and one IPv6")))
+			_, err = utils.IpamAddStatic(store, []string{"v4"}, newAllocation("c1"),
+				[]net.IP{net.ParseIP("fd00:300::5"), net.ParseIP("fd00:300::6")})
+			Expect(err).To(MatchError(ContainSubstring("one IP per address family")))
+			Expect(store.GetByID("c1", "eth0")).To(BeEmpty())
+
+			info, err := utils.IpamAddStatic(store, []string{"v4"}, newAllocation("c1"),
+				[]net.IP{net.ParseIP("fd00:300::5"), net.ParseIP("10.2.0.5")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IPs).To(HaveLen(2))
+		})
+	})
+
+	It("should keep one shim IP per node and pool", func() {
+		info, err := utils.IpamAdd(store, []string{"big"}, newAllocation("c1"))
+		Expect(err).NotTo(HaveOccurred())
+
+		shim, err := utils.IpamShim(store, "node1", info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shim).To(HaveLen(1))
+		Expect(shim[0].IPAddress.String()).To(Equal("10.1.0.2"))
+
+		again, err := utils.IpamShim(store, "node1", info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again[0].IPAddress).To(Equal(shim[0].IPAddress))
+
+		other, err := utils.IpamShim(store, "node2", info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other[0].IPAddress.String()).To(Equal("10.1.0.3"))
+	})
+
+	It("should parse requested IP lists with or without prefix length", func() {
+		ips, err := utils.ParseIPList("10.0.0.5/24, fd00::5")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.5").To4(), net.ParseIP("fd00::5")}))
+		_, err = utils.ParseIPList("10.0.0")
+		Expect(err).To(HaveOccurred())
+	})
+})
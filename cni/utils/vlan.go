@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/alexflint/go-filemutex"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// VlanStateDir 记录每个VLAN子接口被哪些容器使用
+	// 目录结构: <VlanStateDir>/<master.vlan>/<containerID>-<ifName>
+	VlanStateDir = "/var/lib/cni/ts-cni/vlan"
+	// tc-cni自己创建的VLAN子接口打上这个alias，回收时只删带这个alias的
+	vlanAlias = "ts-cni"
+)
+
+// VlanName master上VLAN子接口的名字，例如 eth0.100
+// 网卡名最长15个字符，超长时把master换成hash，例如 vl1a2b3c4d.100
+func VlanName(master string, vlanId string) string {
+	name := master + "." + vlanId
+	if len(name) <= 15 {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(master))
+	return fmt.Sprintf("vl%08x.%s", h.Sum32(), vlanId)
+}
+
+// EnsureVlan 确认master上有vlanId对应的802.1Q子接口，没有就创建并up起来
+// mtu为0时使用master的MTU，同时记录containerID对这个子接口的引用
+func EnsureVlan(master string, vlanId string, mtu int, containerID string, ifName string) (string, error) {
+	vlanName := VlanName(master, vlanId)
+	lock, err := lockVlanState()
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+	defer lock.Unlock()
+
+	if err := ensureVlanLink(master, vlanId, mtu); err != nil {
+		return "", err
+	}
+
+	refDir := filepath.Join(VlanStateDir, vlanName)
+	if err := os.MkdirAll(refDir, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(refDir, vlanRefName(containerID, ifName)), []byte(vlanName), 0644); err != nil {
+		return "", fmt.Errorf("failed to record vlan %s reference: %v", vlanName, err)
+	}
+	return vlanName, nil
+}
+
+func ensureVlanLink(master string, vlanId string, mtu int) error {
+	vlanName := VlanName(master, vlanId)
+	id, err := strconv.Atoi(vlanId)
+	if err != nil || id < 1 || id > 4094 {
+		return fmt.Errorf("invalid vlan id %q, must be [1, 4094]", vlanId)
+	}
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+	// 同名的网卡已经存在时，必须是master上同一个VLAN ID的子接口，否则pod会接到错误的网络上
+	if link, err := netlink.LinkByName(vlanName); err == nil {
+		vlan, ok := link.(*netlink.Vlan)
+		if !ok || vlan.VlanId != id || vlan.ParentIndex != m.Attrs().Index {
+			return fmt.Errorf("link %q already exists but is not vlan %d on %q", vlanName, id, master)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			if err := netlink.LinkSetUp(link); err != nil {
+				return fmt.Errorf("failed to set %q UP: %v", vlanName, err)
+			}
+		}
+		return nil
+	}
+
+	if mtu == 0 {
+		mtu = m.Attrs().MTU
+	}
+	if mtu > m.Attrs().MTU {
+		return fmt.Errorf("invalid vlan MTU %d, must be [0, master MTU(%d)]", mtu, m.Attrs().MTU)
+	}
+
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        vlanName,
+			MTU:         mtu,
+			ParentIndex: m.Attrs().Index,
+		},
+		VlanId: id,
+	}
+	log.Println("创建VLAN子接口=", vlanName)
+	if err := netlink.LinkAdd(vlan); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to create vlan %q: %v", vlanName, err)
+	}
+	link, err := netlink.LinkByName(vlanName)
+	if err != nil {
+		return fmt.Errorf("failed to refetch vlan %q: %v", vlanName, err)
+	}
+	if err := netlink.LinkSetAlias(link, vlanAlias); err != nil {
+		return fmt.Errorf("failed to set alias on vlan %q: %v", vlanName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", vlanName, err)
+	}
+	return nil
+}
+
+// ReleaseVlan 删除containerID对VLAN子接口的引用
+// gc为true时，子接口没有任何引用、主机上也没有挂在它上面的网卡(例如shim)并且是tc-cni创建的，就把它删掉
+func ReleaseVlan(containerID string, ifName string, gc bool) error {
+	lock, err := lockVlanState()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	defer lock.Unlock()
+
+	refs, err := filepath.Glob(filepath.Join(VlanStateDir, "*", vlanRefName(containerID, ifName)))
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := os.Remove(ref); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !gc {
+			continue
+		}
+		refDir := filepath.Dir(ref)
+		left, err := ioutil.ReadDir(refDir)
+		if err != nil || len(left) > 0 {
+			continue
+		}
+		vlanName := filepath.Base(refDir)
+		link, err := netlink.LinkByName(vlanName)
+		if err != nil || link.Attrs().Alias != vlanAlias {
+			_ = os.Remove(refDir)
+			continue
+		}
+		if children, err := vlanChildren(link); err != nil || len(children) > 0 {
+			log.Printf("VLAN子接口 %s 上还有网卡 %v, 不回收 \n", vlanName, children)
+			continue
+		}
+		log.Println("回收没有macvlan的VLAN子接口=", vlanName)
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete vlan %q: %v", vlanName, err)
+		}
+		_ = os.Remove(refDir)
+	}
+	return nil
+}
+
+// vlanChildren 主机网络命名空间里parent是link的网卡，pod里的macvlan/ipvlan看不到，靠引用文件计数
+func vlanChildren(link netlink.Link) ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, l := range links {
+		if l.Attrs().ParentIndex == link.Attrs().Index && l.Attrs().Index != link.Attrs().Index {
+			names = append(names, l.Attrs().Name)
+		}
+	}
+	return names, nil
+}
+
+func vlanRefName(containerID string, ifName string) string {
+	return strings.Replace(containerID+"-"+ifName, "/", "_", -1)
+}
+
+func lockVlanState() (*filemutex.FileMutex, error) {
+	if err := os.MkdirAll(VlanStateDir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := filemutex.New(filepath.Join(VlanStateDir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Lock(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
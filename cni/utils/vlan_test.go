@@ -0,0 +1,21 @@
+package utils_test
+
+import (
+	"ts-cni/cni/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VlanName", func() {
+	It("should fit in an interface name and keep the vlan id", func() {
+		Expect(utils.VlanName("eth0", "100")).To(Equal("eth0.100"))
+		Expect(utils.VlanName("enp175s0f1", "4094")).To(Equal("enp175s0f1.4094"))
+
+		long := utils.VlanName("enp175s0f1np1", "4094")
+		Expect(len(long)).To(BeNumerically("<=", 15))
+		Expect(long).To(HaveSuffix(".4094"))
+		Expect(utils.VlanName("enp175s0f1np1", "4094")).To(Equal(long))
+		Expect(utils.VlanName("enp175s0f0np0", "4094")).NotTo(Equal(long))
+	})
+})
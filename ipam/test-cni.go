@@ -7,8 +7,14 @@ import (
 )
 
 func main() {
-	K8sClient := utils.NewK8s()
+	K8sClient, err := utils.NewK8s("/etc/kubernetes/admin.conf")
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println(K8sClient)
-	netArr := K8sClient.GetPodNet("default", "nginx-test-5f6cc55c7f-jxrsq")
+	netArr, err := K8sClient.GetPodNet("default", "nginx-test-5f6cc55c7f-jxrsq")
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Println("CNI NetArr的值=", netArr)
 }
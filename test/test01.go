@@ -2,12 +2,12 @@ package main
 
 import (
 	"fmt"
+	"ts-cni/cni/structs"
 	"ts-cni/cni/utils"
 )
 
 func main() {
-	a := utils.EtcdClient{}
-	a.EtcdConnect()
+	a, _ := utils.NewEtcdClient(&structs.EtcdConf{Endpoints: []string{"172.17.47.201:2379"}})
 	b := a.EtcdGet("/i", false).(string)
 	a.EtcdDisconnect()
 	fmt.Println(b)
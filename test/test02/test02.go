@@ -1,12 +1,16 @@
 package main
 
 import (
+	"log"
+	"ts-cni/cni/structs"
 	"ts-cni/cni/utils"
 )
 
 func main() {
-	a := utils.EtcdClient{}
-	a.EtcdConnect()
+	a, err := utils.NewEtcdClient(&structs.EtcdConf{Endpoints: []string{"172.17.47.201:2379"}})
+	if err != nil {
+		log.Fatal(err)
+	}
 	//lock, err := a.Lock("/172.11.11.11")
 	//if err != nil {
 	//	fmt.Println("groutine1抢锁失败")
@@ -16,7 +20,8 @@ func main() {
 	//lock := clientv3.LeaseID(int64(112443675516528807))
 	//a.UnLock("112443645227571081")
 	//a.SearchLocks("")
-	a.UnLock("112443645227571118")
+	reserved, err := a.EtcdReserve("/ipam/172.11.11.0/172.11.11.11", "test02")
+	log.Println("reserved=", reserved, "err=", err)
 	//a.TestLock()
 	a.EtcdDisconnect()
 }
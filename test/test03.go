@@ -7,8 +7,8 @@ import (
 )
 
 func main() {
-	K8sClient := utils.NewK8s()
+	K8sClient, _ := utils.NewK8s("")
 	fmt.Println(K8sClient)
-	netArr := K8sClient.GetPodNet("default", "nginx-test-5f6cc55c7f-jxrsq")
+	netArr, _ := K8sClient.GetPodNet("default", "nginx-test-5f6cc55c7f-jxrsq")
 	log.Println("CNI NetArr的值=", netArr)
 }
@@ -6,8 +6,8 @@ import (
 )
 
 func main() {
-	a := utils.NewK8s()
+	a, _ := utils.NewK8s("")
 	//fmt.Println(*a.Client)
-	b := a.GetPodNet("default", "nginx-test-847b659596-cfzcl")
+	b, _ := a.GetPodNet("default", "nginx-test-847b659596-cfzcl")
 	fmt.Println(b)
 }
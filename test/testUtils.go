@@ -10,8 +10,8 @@ type N struct {
 }
 
 func main() {
-	K8sClient := utils.NewK8s()
-	netArr := K8sClient.GetPodNet("default", "nginx-test-847b659596-cfzcl")
+	K8sClient, _ := utils.NewK8s("")
+	netArr, _ := K8sClient.GetPodNet("default", "nginx-test-847b659596-cfzcl")
 	etcdClient := utils.Client{}
 	etcdClient.EtcdConnect()
 	// 取etcd中存储的所有的网段
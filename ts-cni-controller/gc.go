@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"ts-cni/cni/backend"
+	"ts-cni/cni/utils"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// GarbageCollector 回收cmdDel失败留下的IP分配记录和已经删除的节点的shim地址
+// 记录对应的pod不存在、已经结束、或者不是pod当前sandbox的记录时认为是孤儿，
+// 连续grace时间都是孤儿才释放，每次释放写一条审计日志
+// DAD发现冲突的IP保留conflictHold以后再放回地址池，0表示一直保留，只能由运维删除记录
+type GarbageCollector struct {
+	k8s          *utils.K8s
+	store        backend.Store
+	grace        time.Duration
+	conflictHold time.Duration
+	interval     time.Duration
+	audit        *log.Logger
+	// 第一次发现是孤儿的时间
+	suspects map[string]time.Time
+	now      func() time.Time
+}
+
+func NewGarbageCollector(k8s *utils.K8s, store backend.Store, interval time.Duration, grace time.Duration, conflictHold time.Duration, audit *log.Logger) *GarbageCollector {
+	return &GarbageCollector{
+		k8s:          k8s,
+		store:        store,
+		grace:        grace,
+		conflictHold: conflictHold,
+		interval:     interval,
+		audit:        audit,
+		suspects:     make(map[string]time.Time),
+		now:          time.Now,
+	}
+}
+
+func (gc *GarbageCollector) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if err := gc.Collect(); err != nil {
+			log.Println("GC 回收IP失败, err=", err)
+		}
+	}
+}
+
+// Collect 检查一遍所有的分配记录
+func (gc *GarbageCollector) Collect() error {
+	records, err := gc.store.Records()
+	if err != nil {
+		return err
+	}
+	now := gc.now()
+	pods := make(map[string]*corev1.Pod)
+	seen := make(map[string]bool)
+	for _, r := range records {
+		reason, err := gc.orphanReason(r, pods)
+		if err != nil {
+			log.Println("GC 检查分配记录失败, err=", err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		key := suspectKey(r)
+		seen[key] = true
+		first, ok := gc.suspects[key]
+		if !ok {
+			log.Printf("GC 发现孤儿IP %s/%s: %s, %v后回收 \n", r.Pool, r.IP, reason, gc.grace)
+			gc.suspects[key] = now
+			continue
+		}
+		if now.Sub(first) < gc.grace || now.Sub(r.Allocation.Timestamp) < gc.grace {
+			continue
+		}
+		if err := gc.release(r, reason); err != nil {
+			log.Println("GC 释放IP失败, err=", err)
+			continue
+		}
+		delete(gc.suspects, key)
+	}
+	// 不再是孤儿或者已经被释放的记录不用再等
+	for key := range gc.suspects {
+		if !seen[key] {
+			delete(gc.suspects, key)
+		}
+	}
+	return nil
+}
+
+// orphanReason 返回记录是孤儿的原因，不是孤儿返回空
+func (gc *GarbageCollector) orphanReason(r *backend.Record, pods map[string]*corev1.Pod) (string, error) {
+	a := r.Allocation
+	if a.Conflict != "" {
+		if gc.conflictHold <= 0 || gc.now().Sub(a.Timestamp) < gc.conflictHold {
+			return "", nil
+		}
+		return fmt.Sprintf("address conflict older than %v: %s", gc.conflictHold, a.Conflict), nil
+	}
+	if a.Node != "" && a.ContainerID == utils.ShimContainerID(a.Node) {
+		node, err := gc.k8s.GetNode(a.Node)
+		if err != nil || node != nil {
+			return "", err
+		}
+		return "node not found", nil
+	}
+	if a.ContainerID == "" {
+		if !a.Retained() {
+			return "", nil
+		}
+		retained, err := gc.k8s.StickyRetained(a.Sticky)
+		if err != nil || retained {
+			return "", err
+		}
+		return "statefulset scaled down or deleted", nil
+	}
+	// 老格式的记录不知道是哪个pod，不回收
+	if a.PodName == "" {
+		return "", nil
+	}
+
+	podKey := a.PodNamespace + "/" + a.PodName
+	pod, ok := pods[podKey]
+	if !ok {
+		var err error
+		if pod, err = gc.k8s.GetPod(a.PodNamespace, a.PodName); err != nil {
+			return "", err
+		}
+		pods[podKey] = pod
+	}
+	switch {
+	case pod == nil:
+		return "pod not found", nil
+	case pod.DeletionTimestamp != nil:
+		// pod正在删除，kubelet会调用DEL
+		return "", nil
+	case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+		return fmt.Sprintf("pod %s", pod.Status.Phase), nil
+	}
+	// ADD成功后pod上记录了当前sandbox的容器ID，每个网卡都一样，和它不同的是旧sandbox留下的
+	// 没有这个注解的pod(升级之前创建的)只在pod不存在或者结束以后回收
+	if id := pod.Annotations[utils.ContainerIDAnnotation]; id != "" && id != a.ContainerID {
+		return fmt.Sprintf("pod sandbox is now %s", id), nil
+	}
+	return "", nil
+}
+
+// release 只释放这一条记录，同一个容器的其他记录各自检查、各自写审计日志
+// 按读出来时的版本释放，期间被重新分配或者被Rebind的记录不会被误删
+func (gc *GarbageCollector) release(r *backend.Record, reason string) error {
+	if err := gc.store.Lock(); err != nil {
+		return err
+	}
+	defer gc.store.Unlock()
+
+	a := r.Allocation
+	action := "released"
+	var done bool
+	var err error
+	if a.ContainerID != "" && a.Retained() {
+		// StatefulSet还要用的IP只去掉容器信息，和DEL一样
+		action = "detached"
+		done, err = gc.store.Update(r, a.Detach())
+	} else {
+		done, err = gc.store.Release(r)
+	}
+	if err != nil {
+		return err
+	}
+	if !done {
+		log.Printf("GC 分配记录 %s/%s 已经变了, 不释放 \n", r.Pool, r.IP)
+		return nil
+	}
+	gc.audit.Printf("GC %s pool=%s ip=%s containerID=%s ifName=%s pod=%s/%s node=%s sticky=%s allocated=%s reason=%q",
+		action, r.Pool, r.IP, a.ContainerID, a.IfName, a.PodNamespace, a.PodName, a.Node, a.Sticky, a.Timestamp.Format(time.RFC3339), reason)
+	return nil
+}
+
+func suspectKey(r *backend.Record) string {
+	return r.Pool + "/" + r.IP.String() + "/" + r.Allocation.ContainerID
+}
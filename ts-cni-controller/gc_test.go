@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"time"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	fakestore "ts-cni/cni/backend/testing"
+	"ts-cni/cni/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("GarbageCollector", func() {
+	var (
+		store    *fakestore.FakeStore
+		gc       *GarbageCollector
+		auditBuf *bytes.Buffer
+		now      time.Time
+		longAgo  time.Time
+	)
+
+	reserve := func(ip string, alloc *backend.Allocation) {
+		ok, err := store.Reserve(alloc, net.ParseIP(ip), "web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+	}
+	allocation := func(id string, pod string) *backend.Allocation {
+		return &backend.Allocation{ContainerID: id, IfName: "eth0", PodNamespace: "default", PodName: pod, Timestamp: longAgo}
+	}
+	reserved := func() []net.IP {
+		ips, err := store.Reserved("web")
+		Expect(err).NotTo(HaveOccurred())
+		return ips
+	}
+
+	BeforeEach(func() {
+		now = time.Now()
+		longAgo = now.Add(-time.Hour)
+		pool, err := allocator.LoadPool("web", `{"subnet":"10.1.0.0/24","vlan":"100"}`)
+		Expect(err).NotTo(HaveOccurred())
+		store = fakestore.NewFakeStore([]*allocator.Pool{pool})
+
+		replicas := int32(1)
+		client := fake.NewSimpleClientset(
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "live",
+					Annotations: map[string]string{utils.ContainerIDAnnotation: "live-sandbox"},
+				},
+				Status: corev1.PodStatus{
+					Phase:  corev1.PodRunning,
+					PodIP:  "10.1.0.2",
+					PodIPs: []corev1.PodIP{{IP: "10.1.0.2"}},
+				},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "done"},
+				Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+			},
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			&appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+				Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+			},
+		)
+		auditBuf = &bytes.Buffer{}
+		gc = NewGarbageCollector(utils.NewK8sForClients(client, nil, nil), store, time.Minute, 10*time.Minute, 24*time.Hour, log.New(auditBuf, "", 0))
+		gc.now = func() time.Time { return now }
+	})
+
+	It("should release orphans only after the grace period", func() {
+		reserve("10.1.0.2", allocation("live-sandbox", "live"))
+		reserve("10.1.0.3", allocation("old-sandbox", "live"))
+		reserve("10.1.0.4", allocation("gone-sandbox", "gone"))
+		reserve("10.1.0.5", allocation("done-sandbox", "done"))
+		reserve("10.1.0.6", &backend.Allocation{ContainerID: "legacy", IfName: "eth0"})
+
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(HaveLen(5))
+
+		now = now.Add(11 * time.Minute)
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(ConsistOf([]net.IP{net.ParseIP("10.1.0.2"), net.ParseIP("10.1.0.6")}))
+		Expect(auditBuf.String()).To(ContainSubstring("ip=10.1.0.4 containerID=gone-sandbox"))
+		Expect(auditBuf.String()).To(ContainSubstring(`reason="pod not found"`))
+	})
+
+	It("should release records of an old sandbox on any interface", func() {
+		reserve("10.1.0.2", allocation("live-sandbox", "live"))
+		secondary := allocation("live-sandbox", "live")
+		secondary.IfName = "net1"
+		reserve("10.1.0.10", secondary)
+		stale := allocation("old-sandbox", "live")
+		stale.IfName = "net1"
+		reserve("10.1.0.11", stale)
+
+		Expect(gc.Collect()).To(Succeed())
+		now = now.Add(11 * time.Minute)
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(ConsistOf([]net.IP{net.ParseIP("10.1.0.2"), net.ParseIP("10.1.0.10")}))
+		Expect(auditBuf.String()).To(ContainSubstring(`ip=10.1.0.11 containerID=old-sandbox ifName=net1`))
+		Expect(auditBuf.String()).To(ContainSubstring(`reason="pod sandbox is now live-sandbox"`))
+	})
+
+	It("should audit every record released for a container", func() {
+		reserve("10.1.0.4", allocation("gone-sandbox", "gone"))
+		secondary := allocation("gone-sandbox", "gone")
+		secondary.IfName = "net1"
+		reserve("10.1.0.5", secondary)
+		sticky := allocation("gone-db", "db-0")
+		sticky.Sticky = "default/db/0"
+		reserve("10.1.0.6", sticky)
+
+		Expect(gc.Collect()).To(Succeed())
+		now = now.Add(11 * time.Minute)
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(ConsistOf([]net.IP{net.ParseIP("10.1.0.6")}))
+		Expect(auditBuf.String()).To(ContainSubstring("GC released pool=web ip=10.1.0.4 containerID=gone-sandbox ifName=eth0"))
+		Expect(auditBuf.String()).To(ContainSubstring("GC released pool=web ip=10.1.0.5 containerID=gone-sandbox ifName=net1"))
+		Expect(auditBuf.String()).To(ContainSubstring("GC detached pool=web ip=10.1.0.6 containerID=gone-db"))
+		Expect(store.GetByID("gone-db", "eth0")).To(BeEmpty())
+	})
+
+	It("should release shim IPs of deleted nodes", func() {
+		shim := func(node string) *backend.Allocation {
+			return &backend.Allocation{ContainerID: utils.ShimContainerID(node), IfName: "web", Node: node, Timestamp: longAgo}
+		}
+		reserve("10.1.0.20", shim("node-1"))
+		reserve("10.1.0.21", shim("node-2"))
+
+		Expect(gc.Collect()).To(Succeed())
+		now = now.Add(11 * time.Minute)
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(ConsistOf([]net.IP{net.ParseIP("10.1.0.20")}))
+		Expect(auditBuf.String()).To(ContainSubstring(`ip=10.1.0.21 containerID=ts-cni-shim-node-2`))
+		Expect(auditBuf.String()).To(ContainSubstring(`reason="node not found"`))
+	})
+
+	It("should hold conflicting IPs for the conflict hold period", func() {
+		conflict := func(ip string, at time.Time) {
+			a := allocation("", "gone").MarkConflict("address already in use: " + ip)
+			a.Timestamp = at
+			reserve(ip, a)
+		}
+		conflict("10.1.0.30", longAgo)
+		conflict("10.1.0.31", now.Add(-25*time.Hour))
+
+		Expect(gc.Collect()).To(Succeed())
+		now = now.Add(11 * time.Minute)
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(ConsistOf([]net.IP{net.ParseIP("10.1.0.30")}))
+		Expect(auditBuf.String()).To(ContainSubstring(`GC released pool=web ip=10.1.0.31 containerID= ifName=`))
+		Expect(auditBuf.String()).To(ContainSubstring(`reason="address conflict older than 24h0m0s: address already in use: 10.1.0.31"`))
+	})
+
+	It("should forget suspects that are no longer orphans", func() {
+		reserve("10.1.0.3", allocation("old-sandbox", "live"))
+		Expect(gc.Collect()).To(Succeed())
+		Expect(gc.suspects).To(HaveLen(1))
+
+		records, err := store.Records()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Release(records[0])).To(BeTrue())
+		Expect(gc.Collect()).To(Succeed())
+		Expect(gc.suspects).To(BeEmpty())
+	})
+
+	It("should keep sticky IPs while the StatefulSet still has the ordinal", func() {
+		reserve("10.1.0.7", &backend.Allocation{Sticky: "default/db/0", Timestamp: longAgo})
+		reserve("10.1.0.8", &backend.Allocation{Sticky: "default/db/1", Timestamp: longAgo})
+
+		Expect(gc.Collect()).To(Succeed())
+		now = now.Add(11 * time.Minute)
+		Expect(gc.Collect()).To(Succeed())
+		Expect(reserved()).To(ConsistOf([]net.IP{net.ParseIP("10.1.0.7")}))
+	})
+})
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"ts-cni/cni/allocator"
+	tscniv1 "ts-cni/cni/apis/v1"
+	"ts-cni/cni/backend"
+	"ts-cni/cni/backend/crd"
+	"ts-cni/cni/backend/etcd"
+	"ts-cni/cni/client"
+	"ts-cni/cni/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// managedBy 写到etcd地址池配置里的标记，只有带这个标记的地址池才会被controller删除，
+// 手工写入的老地址池不受影响
+const managedBy = "ts-cni-controller"
+
+// poolFinalizer 地址池里还有分配记录时，IPPool上的这个finalizer不让它被真正删除
+const poolFinalizer = "ts-cni.io/pool-in-use"
+
+// managedPool etcd中/ipam/<name>的值，tc-cni的allocator.LoadPool会忽略ManagedBy
+type managedPool struct {
+	*allocator.Pool
+	ManagedBy string `json:"managedBy"`
+}
+
+// PoolController 把IPPool/VLANNetwork同步到etcd的地址池配置，并把使用情况写回IPPool的status
+type PoolController struct {
+	client client.Interface
+	etcd   *utils.EtcdClient
+	store  backend.Store
+
+	pools     cache.Store
+	vlans     cache.Store
+	informers []cache.Controller
+
+	resync  time.Duration
+	trigger chan struct{}
+}
+
+func NewPoolController(c client.Interface, etcdClient *utils.EtcdClient, resync time.Duration) *PoolController {
+	pc := &PoolController{
+		client:  c,
+		etcd:    etcdClient,
+		store:   etcd.NewWithClient(etcdClient),
+		resync:  resync,
+		trigger: make(chan struct{}, 1),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { pc.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { pc.enqueue() },
+		DeleteFunc: func(interface{}) { pc.enqueue() },
+	}
+
+	var poolInformer, vlanInformer cache.Controller
+	pc.pools, poolInformer = cache.NewInformer(&cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return c.IPPools().List(context.TODO(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return c.IPPools().Watch(context.TODO(), opts)
+		},
+	}, &tscniv1.IPPool{}, resync, handler)
+	pc.vlans, vlanInformer = cache.NewInformer(&cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return c.VLANNetworks().List(context.TODO(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return c.VLANNetworks().Watch(context.TODO(), opts)
+		},
+	}, &tscniv1.VLANNetwork{}, resync, handler)
+	pc.informers = []cache.Controller{poolInformer, vlanInformer}
+	return pc
+}
+
+// enqueue 多个事件合并成一次同步
+func (pc *PoolController) enqueue() {
+	select {
+	case pc.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run 资源有变化时同步，另外每隔resync同步一次，更新IP的使用情况
+func (pc *PoolController) Run(stopCh <-chan struct{}) {
+	var synced []cache.InformerSynced
+	for _, inf := range pc.informers {
+		go inf.Run(stopCh)
+		synced = append(synced, inf.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		return
+	}
+	log.Println("IPPool/VLANNetwork 缓存同步完成")
+
+	ticker := time.NewTicker(pc.resync)
+	defer ticker.Stop()
+	for {
+		if err := pc.Sync(); err != nil {
+			log.Println("同步地址池失败, err=", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-pc.trigger:
+		}
+	}
+}
+
+// Sync 同步一次所有的地址池
+func (pc *PoolController) Sync() error {
+	var ipPools []*tscniv1.IPPool
+	for _, obj := range pc.pools.List() {
+		ipPools = append(ipPools, obj.(*tscniv1.IPPool))
+	}
+	vlans := make(map[string]*tscniv1.VLANNetwork)
+	for _, obj := range pc.vlans.List() {
+		vlan := obj.(*tscniv1.VLANNetwork)
+		vlans[vlan.Name] = vlan
+	}
+
+	kvs, err := pc.etcd.EtcdGetPrefix(etcd.RootDir + "/")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]string)
+	for _, kv := range kvs {
+		name := strings.TrimPrefix(kv.K, etcd.RootDir+"/")
+		if name != "" && !strings.Contains(name, "/") {
+			existing[name] = kv.V
+		}
+	}
+	records, err := pc.store.Records()
+	if err != nil {
+		return err
+	}
+
+	plan := planPools(ipPools, vlans, existing, records)
+	for name, value := range plan.puts {
+		log.Println("写入etcd地址池配置=", name, value)
+		if err := pc.etcd.EtcdPut(etcd.RootDir+"/"+name, value); err != nil {
+			return err
+		}
+	}
+	for _, name := range plan.deletes {
+		log.Println("IPPool已经删除, 删除etcd地址池配置=", name)
+		if _, err := pc.etcd.EtcdDelete(etcd.RootDir + "/" + name); err != nil {
+			return err
+		}
+	}
+	for _, name := range plan.retained {
+		log.Println("IPPool已经删除, 但地址池里还有分配记录, 保留etcd地址池配置=", name)
+	}
+	for _, ipPool := range ipPools {
+		if add, ok := plan.finalizers[ipPool.Name]; ok {
+			updated := ipPool.DeepCopy()
+			updated.Finalizers = setFinalizer(updated.Finalizers, add)
+			latest, err := pc.client.IPPools().Update(context.TODO(), updated, metav1.UpdateOptions{})
+			if err != nil {
+				log.Printf("更新IPPool %s 的finalizer失败, err=%v \n", ipPool.Name, err)
+				continue
+			}
+			// 去掉finalizer之后IPPool就被删除了，不用再更新status
+			if !add {
+				continue
+			}
+			ipPool = latest
+		}
+		status := plan.statuses[ipPool.Name]
+		if reflect.DeepEqual(ipPool.Status, status) {
+			continue
+		}
+		updated := ipPool.DeepCopy()
+		updated.Status = status
+		if _, err := pc.client.IPPools().UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{}); err != nil {
+			log.Printf("更新IPPool %s 的status失败, err=%v \n", ipPool.Name, err)
+		}
+	}
+	return nil
+}
+
+// poolPlan 一次同步要做的事情
+type poolPlan struct {
+	// puts 要写入etcd的地址池配置，key是地址池名字
+	puts map[string]string
+	// deletes 要从etcd删除的地址池
+	deletes []string
+	// retained IPPool已经删除，但还有分配记录，继续保留在etcd的地址池
+	retained []string
+	// statuses 每个IPPool新的status
+	statuses map[string]tscniv1.IPPoolStatus
+	// finalizers 要加上(true)或去掉(false)poolFinalizer的IPPool
+	finalizers map[string]bool
+}
+
+// planPools 先创建的IPPool优先，网段和已经接受的地址池(包括手工写入etcd的老地址池)重叠的拒绝同步
+// 删除IPPool时，地址池里还有分配记录就继续保留etcd中的地址池，等IP都释放了再删除
+func planPools(ipPools []*tscniv1.IPPool, vlans map[string]*tscniv1.VLANNetwork, existing map[string]string, records []*backend.Record) *poolPlan {
+	plan := &poolPlan{
+		puts:       make(map[string]string),
+		statuses:   make(map[string]tscniv1.IPPoolStatus),
+		finalizers: make(map[string]bool),
+	}
+	inUse := make(map[string]int)
+	for _, r := range records {
+		inUse[r.Pool]++
+	}
+
+	names := make(map[string]bool, len(ipPools))
+	for _, ipPool := range ipPools {
+		names[ipPool.Name] = true
+	}
+	var accepted []*allocator.Pool
+	for name, value := range existing {
+		if isManaged(value) {
+			if names[name] {
+				continue
+			}
+			if inUse[name] == 0 {
+				plan.deletes = append(plan.deletes, name)
+				continue
+			}
+			plan.retained = append(plan.retained, name)
+			if pool, err := allocator.LoadPool(name, value); err == nil {
+				accepted = append(accepted, pool)
+			}
+			continue
+		}
+		// 同名的IPPool接管手工写入的地址池
+		if names[name] {
+			continue
+		}
+		if pool, err := allocator.LoadPool(name, value); err == nil {
+			accepted = append(accepted, pool)
+		}
+	}
+	sort.Strings(plan.deletes)
+	sort.Strings(plan.retained)
+
+	sorted := append([]*tscniv1.IPPool(nil), ipPools...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].CreationTimestamp, sorted[j].CreationTimestamp
+		if !a.Equal(&b) {
+			return a.Before(&b)
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	for _, ipPool := range sorted {
+		if ipPool.DeletionTimestamp != nil {
+			accepted = planDeletingPool(plan, ipPool, existing, inUse, accepted)
+			continue
+		}
+		if !hasFinalizer(ipPool.Finalizers) {
+			plan.finalizers[ipPool.Name] = true
+		}
+		status := tscniv1.IPPoolStatus{}
+		pool, err := poolFor(ipPool, vlans)
+		if err != nil {
+			status.Message = err.Error()
+			plan.statuses[ipPool.Name] = status
+			continue
+		}
+		fillUsage(&status, pool, records)
+		if other := overlapping(accepted, pool); other != nil {
+			status.Message = fmt.Sprintf("cidr %s overlaps with pool %s (%s)", pool.IPNet(), other.Name, other.IPNet())
+			plan.statuses[ipPool.Name] = status
+			continue
+		}
+		accepted = append(accepted, pool)
+		status.Synced = true
+		plan.statuses[ipPool.Name] = status
+
+		data, _ := json.Marshal(&managedPool{Pool: pool, ManagedBy: managedBy})
+		if existing[ipPool.Name] != string(data) {
+			plan.puts[ipPool.Name] = string(data)
+		}
+	}
+	return plan
+}
+
+// planDeletingPool 正在删除的IPPool: 没有分配记录了就删除etcd地址池并去掉finalizer，
+// 否则保留etcd地址池，status里写明原因，并且不再同步，CRD地址池来源不会再从它分配IP
+func planDeletingPool(plan *poolPlan, ipPool *tscniv1.IPPool, existing map[string]string, inUse map[string]int, accepted []*allocator.Pool) []*allocator.Pool {
+	value, ok := existing[ipPool.Name]
+	if inUse[ipPool.Name] == 0 {
+		if ok && isManaged(value) {
+			plan.deletes = append(plan.deletes, ipPool.Name)
+			sort.Strings(plan.deletes)
+		}
+		if hasFinalizer(ipPool.Finalizers) {
+			plan.finalizers[ipPool.Name] = false
+		}
+		return accepted
+	}
+
+	status := ipPool.Status
+	status.Synced = false
+	status.Message = fmt.Sprintf("IPPool is being deleted, %d IPs are still allocated", inUse[ipPool.Name])
+	plan.statuses[ipPool.Name] = status
+	if ok {
+		if pool, err := allocator.LoadPool(ipPool.Name, value); err == nil {
+			accepted = append(accepted, pool)
+		}
+	}
+	return accepted
+}
+
+func hasFinalizer(finalizers []string) bool {
+	for _, f := range finalizers {
+		if f == poolFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// setFinalizer 加上或去掉poolFinalizer，其他finalizer不变
+func setFinalizer(finalizers []string, add bool) []string {
+	var result []string
+	for _, f := range finalizers {
+		if f != poolFinalizer {
+			result = append(result, f)
+		}
+	}
+	if add {
+		result = append(result, poolFinalizer)
+	}
+	return result
+}
+
+func poolFor(ipPool *tscniv1.IPPool, vlans map[string]*tscniv1.VLANNetwork) (*allocator.Pool, error) {
+	vlan, ok := vlans[ipPool.Spec.VLAN]
+	if !ok {
+		return nil, fmt.Errorf("VLANNetwork %s not found", ipPool.Spec.VLAN)
+	}
+	return crd.PoolFromCRD(ipPool, vlan)
+}
+
+// fillUsage 按etcd中的分配记录统计地址池的使用情况
+func fillUsage(status *tscniv1.IPPoolStatus, pool *allocator.Pool, records []*backend.Record) {
+	status.Total = math.MaxInt64
+	if capacity := pool.Capacity(); capacity.IsInt64() {
+		status.Total = capacity.Int64()
+	}
+	for _, r := range records {
+		if r.Pool != pool.Name {
+			continue
+		}
+		if r.Allocation.ContainerID == "" && r.Allocation.Retained() {
+			status.Reserved++
+		} else {
+			status.Allocated++
+		}
+	}
+	if status.Free = status.Total - status.Allocated - status.Reserved; status.Free < 0 {
+		status.Free = 0
+	}
+}
+
+func overlapping(pools []*allocator.Pool, pool *allocator.Pool) *allocator.Pool {
+	for _, p := range pools {
+		if netOverlap(p.IPNet(), pool.IPNet()) {
+			return p
+		}
+	}
+	return nil
+}
+
+func netOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func isManaged(value string) bool {
+	var m struct {
+		ManagedBy string `json:"managedBy"`
+	}
+	return json.Unmarshal([]byte(value), &m) == nil && m.ManagedBy == managedBy
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"ts-cni/cni/allocator"
+	tscniv1 "ts-cni/cni/apis/v1"
+	"ts-cni/cni/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newIPPool(name string, cidr string, created time.Time) *tscniv1.IPPool {
+	return &tscniv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(created)},
+		Spec:       tscniv1.IPPoolSpec{CIDR: cidr, VLAN: "vlan100"},
+	}
+}
+
+func newRecord(pool string, ip string, alloc *backend.Allocation) *backend.Record {
+	return &backend.Record{Pool: pool, IP: net.ParseIP(ip), Allocation: alloc}
+}
+
+var _ = Describe("planPools", func() {
+	var vlans map[string]*tscniv1.VLANNetwork
+	now := time.Now()
+
+	BeforeEach(func() {
+		vlans = map[string]*tscniv1.VLANNetwork{
+			"vlan100": {ObjectMeta: metav1.ObjectMeta{Name: "vlan100"}, Spec: tscniv1.VLANNetworkSpec{VlanID: 100}},
+		}
+	})
+
+	It("should write new pools to etcd and report usage", func() {
+		records := []*backend.Record{
+			newRecord("web", "10.1.0.2", &backend.Allocation{ContainerID: "c1", IfName: "eth0"}),
+			newRecord("web", "10.1.0.3", &backend.Allocation{Sticky: "default/db/0"}),
+			newRecord("other", "10.9.0.2", &backend.Allocation{ContainerID: "c2", IfName: "eth0"}),
+		}
+		plan := planPools([]*tscniv1.IPPool{newIPPool("web", "10.1.0.0/24", now)}, vlans, nil, records)
+
+		Expect(plan.puts).To(HaveKey("web"))
+		Expect(isManaged(plan.puts["web"])).To(BeTrue())
+		pool, err := allocator.LoadPool("web", plan.puts["web"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.VlanId).To(Equal("100"))
+
+		Expect(plan.statuses["web"]).To(Equal(tscniv1.IPPoolStatus{
+			Synced:    true,
+			Total:     253,
+			Allocated: 1,
+			Reserved:  1,
+			Free:      251,
+		}))
+	})
+
+	It("should not rewrite pools that are already in sync", func() {
+		ipPools := []*tscniv1.IPPool{newIPPool("web", "10.1.0.0/24", now)}
+		first := planPools(ipPools, vlans, nil, nil)
+		second := planPools(ipPools, vlans, first.puts, nil)
+		Expect(second.puts).To(BeEmpty())
+		Expect(second.deletes).To(BeEmpty())
+	})
+
+	It("should reject the newer of two overlapping pools", func() {
+		plan := planPools([]*tscniv1.IPPool{
+			newIPPool("newer", "10.1.0.128/25", now),
+			newIPPool("older", "10.1.0.0/24", now.Add(-time.Hour)),
+		}, vlans, nil, nil)
+		Expect(plan.puts).To(HaveKey("older"))
+		Expect(plan.puts).NotTo(HaveKey("newer"))
+		Expect(plan.statuses["newer"].Synced).To(BeFalse())
+		Expect(plan.statuses["newer"].Message).To(ContainSubstring("overlaps with pool older"))
+	})
+
+	It("should reject pools overlapping hand-written etcd pools", func() {
+		existing := map[string]string{"10.1.0.0": "100"}
+		plan := planPools([]*tscniv1.IPPool{newIPPool("web", "10.1.0.0/16", now)}, vlans, existing, nil)
+		Expect(plan.puts).To(BeEmpty())
+		Expect(plan.statuses["web"].Message).To(ContainSubstring("overlaps"))
+		Expect(plan.deletes).To(BeEmpty())
+	})
+
+	It("should delete managed pools whose IPPool is gone", func() {
+		first := planPools([]*tscniv1.IPPool{newIPPool("web", "10.1.0.0/24", now)}, vlans, nil, nil)
+		plan := planPools(nil, vlans, first.puts, nil)
+		Expect(plan.deletes).To(Equal([]string{"web"}))
+	})
+
+	It("should keep managed pools that still have allocations", func() {
+		first := planPools([]*tscniv1.IPPool{newIPPool("web", "10.1.0.0/24", now)}, vlans, nil, nil)
+		records := []*backend.Record{newRecord("web", "10.1.0.2", &backend.Allocation{ContainerID: "c1", IfName: "eth0"})}
+		plan := planPools([]*tscniv1.IPPool{newIPPool("other", "10.1.0.0/16", now)}, vlans, first.puts, records)
+		Expect(plan.deletes).To(BeEmpty())
+		Expect(plan.retained).To(Equal([]string{"web"}))
+		Expect(plan.statuses["other"].Message).To(ContainSubstring("overlaps with pool web"))
+	})
+
+	It("should hold a finalizer until the deleted IPPool has no allocations", func() {
+		ipPool := newIPPool("web", "10.1.0.0/24", now)
+		first := planPools([]*tscniv1.IPPool{ipPool}, vlans, nil, nil)
+		Expect(first.finalizers).To(Equal(map[string]bool{"web": true}))
+
+		deleted := metav1.NewTime(now)
+		ipPool.Finalizers = []string{poolFinalizer}
+		ipPool.DeletionTimestamp = &deleted
+		records := []*backend.Record{newRecord("web", "10.1.0.2", &backend.Allocation{ContainerID: "c1", IfName: "eth0"})}
+		plan := planPools([]*tscniv1.IPPool{ipPool}, vlans, first.puts, records)
+		Expect(plan.deletes).To(BeEmpty())
+		Expect(plan.finalizers).To(BeEmpty())
+		Expect(plan.statuses["web"].Synced).To(BeFalse())
+		Expect(plan.statuses["web"].Message).To(ContainSubstring("1 IPs are still allocated"))
+
+		plan = planPools([]*tscniv1.IPPool{ipPool}, vlans, first.puts, nil)
+		Expect(plan.deletes).To(Equal([]string{"web"}))
+		Expect(plan.finalizers).To(Equal(map[string]bool{"web": false}))
+	})
+
+	It("should report a missing VLANNetwork", func() {
+		ipPool := newIPPool("web", "10.1.0.0/24", now)
+		ipPool.Spec.VLAN = "missing"
+		plan := planPools([]*tscniv1.IPPool{ipPool}, vlans, nil, nil)
+		Expect(plan.puts).To(BeEmpty())
+		Expect(plan.statuses["web"].Message).To(ContainSubstring("VLANNetwork missing not found"))
+	})
+})
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"ts-cni/cni/backend/etcd"
+	"ts-cni/cni/client"
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+)
+
+// ts-cni-controller 把IPPool/VLANNetwork自定义资源同步到etcd，并在IPPool的status中展示IP的使用情况，
+// 另外定期回收cmdDel失败留下的IP
+// 同一时间只能运行一个副本
+func main() {
+	var etcdConf structs.EtcdConf
+	var endpoints string
+	kubeconfig := flag.String("kubeconfig", "", "kubeconfig路径，不填时使用in-cluster配置")
+	flag.StringVar(&endpoints, "etcd-endpoints", "http://127.0.0.1:2379", "etcd地址，多个用逗号分隔")
+	flag.StringVar(&etcdConf.CAFile, "etcd-cafile", "", "etcd CA证书")
+	flag.StringVar(&etcdConf.CertFile, "etcd-certfile", "", "etcd客户端证书")
+	flag.StringVar(&etcdConf.KeyFile, "etcd-keyfile", "", "etcd客户端私钥")
+	flag.StringVar(&etcdConf.TokenFile, "etcd-token-file", "", "etcd用户认证文件，内容为 username:password")
+	resync := flag.Duration("resync", 30*time.Second, "重新统计地址池使用情况的间隔")
+	gcInterval := flag.Duration("gc-interval", 5*time.Minute, "检查泄漏IP的间隔，0表示不回收")
+	gcGrace := flag.Duration("gc-grace", 10*time.Minute, "分配记录连续多久是孤儿才回收")
+	gcConflictHold := flag.Duration("gc-conflict-hold", 24*time.Hour, "DAD发现冲突的IP保留多久再放回地址池，0表示一直保留，由运维删除记录")
+	gcAuditLog := flag.String("gc-audit-log", "", "回收IP的审计日志文件，不填时输出到标准输出")
+	flag.Parse()
+	etcdConf.Endpoints = strings.Split(endpoints, ",")
+
+	config, err := utils.LoadK8sConfig(*kubeconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	crdClient, err := client.NewForConfig(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	etcdClient, err := utils.NewEtcdClient(&etcdConf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer etcdClient.EtcdDisconnect()
+
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		close(stopCh)
+	}()
+
+	if *gcInterval > 0 {
+		k8sClient, err := utils.NewK8s(*kubeconfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		auditOut := io.Writer(os.Stdout)
+		if *gcAuditLog != "" {
+			f, err := os.OpenFile(*gcAuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			defer f.Close()
+			auditOut = f
+		}
+		audit := log.New(auditOut, "AUDIT ", log.LstdFlags)
+		gc := NewGarbageCollector(k8sClient, etcd.NewWithClient(etcdClient), *gcInterval, *gcGrace, *gcConflictHold, audit)
+		go gc.Run(stopCh)
+	}
+
+	log.Println("ts-cni-controller 启动")
+	NewPoolController(crdClient, etcdClient, *resync).Run(stopCh)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"ts-cni/cni/backend/crd"
+	"ts-cni/cni/ipamd"
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+)
+
+// netConf tc-cni NetConf中daemon用到的部分，存储配置和tc-cni完全一样
+type netConf struct {
+	Etcd         structs.EtcdConf  `json:"etcd"`
+	Store        structs.StoreConf `json:"store"`
+	Kubeconfig   string            `json:"kubeconfig,omitempty"`
+	DaemonSocket string            `json:"daemonSocket,omitempty"`
+	NodeName     string            `json:"nodeName,omitempty"`
+}
+
+// loadNetConf 读取节点上tc-cni的配置文件，conflist时使用配置了daemonSocket的插件
+func loadNetConf(path string) (*netConf, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Plugins []json.RawMessage `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if len(list.Plugins) == 0 {
+		list.Plugins = []json.RawMessage{data}
+	}
+	for _, plugin := range list.Plugins {
+		conf := &netConf{}
+		if err := json.Unmarshal(plugin, conf); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		if conf.DaemonSocket != "" {
+			return conf, nil
+		}
+	}
+	return nil, fmt.Errorf("no plugin in %s has daemonSocket configured", path)
+}
+
+// ts-cni-daemon 每个节点一个，节点上所有tc-cni调用共用一个存储连接和informer缓存，
+// tc-cni在NetConf中配置daemonSocket后只通过unix socket调用它
+// 存储配置从节点上tc-cni的配置文件读取，和tc-cni自己分配IP时的行为一样
+func main() {
+	cniConf := flag.String("cni-conf", "", "节点上tc-cni的配置文件(.conf或.conflist)，etcd、store和kubeconfig从这里读取")
+	socket := flag.String("socket", "", "监听的unix socket，默认使用配置文件中的daemonSocket")
+	kubeconfig := flag.String("kubeconfig", "", "kubeconfig路径，不填时使用配置文件中的kubeconfig，都没有时使用in-cluster配置")
+	node := flag.String("node", "", "节点名，不填时和tc-cni一样: 配置文件中的nodeName -> NODE_NAME环境变量 -> 主机名")
+	resync := flag.Duration("resync", 10*time.Minute, "informer重新同步的间隔")
+	flag.Parse()
+	if *cniConf == "" {
+		log.Fatalln("-cni-conf is required")
+	}
+
+	conf, err := loadNetConf(*cniConf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *socket == "" {
+		*socket = conf.DaemonSocket
+	}
+	if *kubeconfig == "" {
+		*kubeconfig = conf.Kubeconfig
+	}
+	if *node == "" {
+		*node = utils.NodeName(conf.NodeName)
+	}
+
+	store, err := ipamd.NewStore(&conf.Etcd, &conf.Store, *kubeconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		close(stopCh)
+	}()
+
+	k8sClient, err := utils.NewK8s(*kubeconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := k8sClient.StartInformers(*node, *resync, stopCh); err != nil {
+		log.Fatalln(err)
+	}
+	// 地址池来自自定义资源时，IPPool和VLANNetwork也从informer缓存读，ADD不用每次请求apiserver
+	if crdStore, ok := store.(*crd.Store); ok {
+		if err := crdStore.StartInformers(*resync, stopCh); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	ipam := ipamd.NewIPAM(store, k8sClient, *node)
+	defer ipam.Close()
+	log.Println("ts-cni-daemon 启动, 节点=", *node, "存储=", conf.Store.Type)
+	if err := ipamd.NewServer(ipam).Serve(*socket, stopCh); err != nil {
+		log.Fatalln(err)
+	}
+}
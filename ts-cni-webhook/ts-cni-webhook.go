@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"ts-cni/cni/backend/etcd"
+	"ts-cni/cni/structs"
+	"ts-cni/cni/utils"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// ts-cni-webhook 校验工作负载和pod上的app_net、指定IP注解，在创建时就拒绝写错的配置，
+// 而不是等到tc-cni创建sandbox失败
+func main() {
+	var etcdConf structs.EtcdConf
+	var endpoints string
+	listen := flag.String("listen", ":8443", "HTTPS监听地址")
+	certFile := flag.String("tls-cert-file", "/etc/ts-cni/webhook/tls.crt", "webhook服务端证书")
+	keyFile := flag.String("tls-key-file", "/etc/ts-cni/webhook/tls.key", "webhook服务端私钥")
+	warnRatio := flag.Float64("warn-ratio", 0.9, "地址池使用率达到这个比例时返回警告，0表示不警告")
+	flag.StringVar(&endpoints, "etcd-endpoints", "http://127.0.0.1:2379", "etcd地址，多个用逗号分隔")
+	flag.StringVar(&etcdConf.CAFile, "etcd-cafile", "", "etcd CA证书")
+	flag.StringVar(&etcdConf.CertFile, "etcd-certfile", "", "etcd客户端证书")
+	flag.StringVar(&etcdConf.KeyFile, "etcd-keyfile", "", "etcd客户端私钥")
+	flag.StringVar(&etcdConf.TokenFile, "etcd-token-file", "", "etcd用户认证文件，内容为 username:password")
+	flag.Parse()
+	etcdConf.Endpoints = strings.Split(endpoints, ",")
+
+	etcdClient, err := utils.NewEtcdClient(&etcdConf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer etcdClient.EtcdDisconnect()
+
+	validator := NewValidator(etcd.NewWithClient(etcdClient), *warnRatio)
+	mux := http.NewServeMux()
+	mux.Handle("/validate", validator)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	log.Println("ts-cni-webhook 启动, 监听", *listen)
+	log.Fatalln(http.ListenAndServeTLS(*listen, *certFile, *keyFile, mux))
+}
+
+// ServeHTTP 处理apiserver发来的AdmissionReview
+func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = v.Review(review.Request)
+	if !review.Response.Allowed {
+		log.Printf("拒绝 %s %s/%s: %s \n", review.Request.Kind.Kind, review.Request.Namespace, review.Request.Name, review.Response.Result.Message)
+	}
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Printf("写AdmissionReview响应失败: %v \n", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	"ts-cni/cni/utils"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Validator 检查Deployment/StatefulSet/Pod上的app_net和指定IP注解
+// app_net里的地址池必须存在; 指定的IP必须合法，并且在app_net的地址池中可以分配
+type Validator struct {
+	store backend.Store
+	// warnRatio 地址池使用率达到这个比例时返回警告，0表示不警告
+	warnRatio float64
+}
+
+func NewValidator(store backend.Store, warnRatio float64) *Validator {
+	return &Validator{store: store, warnRatio: warnRatio}
+}
+
+// Review 处理一个AdmissionRequest，注解不合法时拒绝，地址池快用完时放行并返回警告
+func (v *Validator) Review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	objects, err := annotatedObjects(req)
+	if err == nil {
+		for _, obj := range objects {
+			var warnings []string
+			warnings, err = v.validate(obj.what, obj.annotations, obj.allowIP)
+			if err != nil {
+				err = fmt.Errorf("%s %s/%s: %v", obj.what, req.Namespace, req.Name, err)
+				break
+			}
+			resp.Warnings = append(resp.Warnings, warnings...)
+		}
+	}
+	if err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    422,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: err.Error(),
+		}
+	}
+	return resp
+}
+
+// annotatedObject 需要检查的一组注解，工作负载自己和它的pod模板都可能带app_net
+type annotatedObject struct {
+	what        string
+	annotations map[string]string
+	// allowIP 指定IP只对单个pod有意义，工作负载上的指定IP也按pod检查
+	allowIP bool
+}
+
+func annotatedObjects(req *admissionv1.AdmissionRequest) ([]annotatedObject, error) {
+	if len(req.Object.Raw) == 0 {
+		return nil, nil
+	}
+	switch req.Kind.Kind {
+	case "Pod":
+		var pod corev1.Pod
+		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+			return nil, fmt.Errorf("failed to decode pod: %v", err)
+		}
+		return []annotatedObject{{"Pod", pod.Annotations, true}}, nil
+	case "Deployment":
+		var d appsv1.Deployment
+		if err := json.Unmarshal(req.Object.Raw, &d); err != nil {
+			return nil, fmt.Errorf("failed to decode deployment: %v", err)
+		}
+		return []annotatedObject{
+			{"Deployment", d.Annotations, false},
+			{"Deployment pod template", d.Spec.Template.Annotations, false},
+		}, nil
+	case "StatefulSet":
+		var s appsv1.StatefulSet
+		if err := json.Unmarshal(req.Object.Raw, &s); err != nil {
+			return nil, fmt.Errorf("failed to decode statefulset: %v", err)
+		}
+		return []annotatedObject{
+			{"StatefulSet", s.Annotations, false},
+			{"StatefulSet pod template", s.Spec.Template.Annotations, false},
+		}, nil
+	}
+	return nil, nil
+}
+
+func (v *Validator) validate(what string, annotations map[string]string, allowIP bool) ([]string, error) {
+	netArr := utils.SplitList(annotations[utils.AppNetAnnotation])
+	requested := annotations[utils.RequestedIPAnnotation]
+	if len(netArr) == 0 && requested == "" {
+		return nil, nil
+	}
+	if requested != "" && !allowIP {
+		return nil, fmt.Errorf("%s must be set on pods, replicas can not share one IP", utils.RequestedIPAnnotation)
+	}
+
+	pools, err := v.store.Pools()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pools: %v", err)
+	}
+	poolMap := make(map[string]*allocator.Pool, len(pools))
+	for _, p := range pools {
+		poolMap[p.Name] = p
+	}
+
+	var candidates []*allocator.Pool
+	for _, name := range netArr {
+		p, ok := poolMap[name]
+		if !ok {
+			return nil, fmt.Errorf("app_net pool %q not found", name)
+		}
+		candidates = append(candidates, p)
+		if pair, ok := poolMap[p.Pair]; ok {
+			candidates = append(candidates, pair)
+		}
+	}
+	// pod上没有app_net时，app_net来自工作负载、namespace或集群默认值，创建时还查不到，只检查IP在某个地址池里
+	if len(netArr) == 0 {
+		candidates = pools
+	}
+
+	var warnings []string
+	if requested != "" {
+		ips, err := utils.ParseIPList(requested)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			p := allocatablePool(candidates, ip)
+			if p == nil {
+				return nil, fmt.Errorf("requested IP %s is not allocatable in app_net pools %v", ip, netArr)
+			}
+			if used, err := v.used(p, ip); err != nil {
+				return nil, err
+			} else if used {
+				warnings = append(warnings, fmt.Sprintf("requested IP %s has been allocated in pool %s", ip, p.Name))
+			}
+		}
+	}
+
+	for _, name := range netArr {
+		if w, err := v.usageWarning(poolMap[name]); err != nil {
+			return nil, err
+		} else if w != "" {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings, nil
+}
+
+// usageWarning 地址池使用率达到warnRatio时返回警告
+func (v *Validator) usageWarning(p *allocator.Pool) (string, error) {
+	if v.warnRatio <= 0 {
+		return "", nil
+	}
+	reserved, err := v.store.Reserved(p.Name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get reserved IPs of pool %s: %v", p.Name, err)
+	}
+	capacity := p.Capacity()
+	if capacity.Sign() <= 0 {
+		return fmt.Sprintf("app_net pool %s has no allocatable IP", p.Name), nil
+	}
+	ratio, _ := new(big.Float).Quo(new(big.Float).SetInt64(int64(len(reserved))), new(big.Float).SetInt(capacity)).Float64()
+	if ratio < v.warnRatio {
+		return "", nil
+	}
+	return fmt.Sprintf("app_net pool %s is nearly exhausted: %d/%s IPs allocated", p.Name, len(reserved), capacity.String()), nil
+}
+
+func (v *Validator) used(p *allocator.Pool, ip net.IP) (bool, error) {
+	reserved, err := v.store.Reserved(p.Name)
+	if err != nil {
+		return false, fmt.Errorf("failed to get reserved IPs of pool %s: %v", p.Name, err)
+	}
+	for _, r := range reserved {
+		if r.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func allocatablePool(pools []*allocator.Pool, ip net.IP) *allocator.Pool {
+	for _, p := range pools {
+		if p.Allocatable(ip) {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+
+	"ts-cni/cni/allocator"
+	"ts-cni/cni/backend"
+	fakestore "ts-cni/cni/backend/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func podRequest(annotations map[string]string) *admissionv1.AdmissionRequest {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1", Annotations: annotations}}
+	raw, err := json.Marshal(pod)
+	Expect(err).NotTo(HaveOccurred())
+	return &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Name:      "web-1",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+var _ = Describe("Validator", func() {
+	var (
+		store     *fakestore.FakeStore
+		validator *Validator
+	)
+
+	BeforeEach(func() {
+		var pools []*allocator.Pool
+		for name, value := range map[string]string{
+			"small":  `{"subnet":"10.0.0.0/29","gateway":"10.0.0.1","vlan":"100"}`,
+			"big":    `{"subnet":"10.1.0.0/24","gateway":"10.1.0.254","vlan":"200","pair":"big-v6"}`,
+			"big-v6": `{"subnet":"fd00:200::/120","vlan":"200"}`,
+		} {
+			p, err := allocator.LoadPool(name, value)
+			Expect(err).NotTo(HaveOccurred())
+			pools = append(pools, p)
+		}
+		store = fakestore.NewFakeStore(pools)
+		validator = NewValidator(store, 0.8)
+	})
+
+	DescribeTable("pod annotations",
+		func(annotations map[string]string, allowed bool, message string) {
+			resp := validator.Review(podRequest(annotations))
+			Expect(resp.UID).To(BeEquivalentTo("uid-1"))
+			Expect(resp.Allowed).To(Equal(allowed))
+			if !allowed {
+				Expect(resp.Result.Message).To(ContainSubstring(message))
+			}
+		},
+		Entry("no annotations", nil, true, ""),
+		Entry("known pools", map[string]string{"app_net": "small, big"}, true, ""),
+		Entry("unknown pool", map[string]string{"app_net": "big,missing"}, false, `pool "missing" not found`),
+		Entry("requested IP in pool", map[string]string{"app_net": "big", "ts-cni/requested-ip": "10.1.0.10,fd00:200::10"}, true, ""),
+		Entry("requested IP with prefix length", map[string]string{"app_net": "big", "ts-cni/requested-ip": "10.1.0.10/24"}, true, ""),
+		Entry("malformed CIDR", map[string]string{"app_net": "big", "ts-cni/requested-ip": "10.1.0.10/33"}, false, "10.1.0.10/33"),
+		Entry("IP outside the pools", map[string]string{"app_net": "small", "ts-cni/requested-ip": "10.1.0.10"}, false, "not allocatable"),
+		Entry("gateway IP", map[string]string{"app_net": "big", "ts-cni/requested-ip": "10.1.0.254"}, false, "not allocatable"),
+		Entry("IP without app_net", map[string]string{"ts-cni/requested-ip": "10.0.0.3"}, true, ""),
+	)
+
+	It("should reject requested IPs on workloads", func() {
+		d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web"}}
+		d.Spec.Template.Annotations = map[string]string{"app_net": "big", "ts-cni/requested-ip": "10.1.0.10"}
+		raw, err := json.Marshal(d)
+		Expect(err).NotTo(HaveOccurred())
+		resp := validator.Review(&admissionv1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Object: runtime.RawExtension{Raw: raw},
+		})
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Message).To(ContainSubstring("Deployment pod template"))
+	})
+
+	It("should check the app_net of StatefulSets", func() {
+		s := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Annotations: map[string]string{"app_net": "nope"}}}
+		raw, err := json.Marshal(s)
+		Expect(err).NotTo(HaveOccurred())
+		resp := validator.Review(&admissionv1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+			Object: runtime.RawExtension{Raw: raw},
+		})
+		Expect(resp.Allowed).To(BeFalse())
+	})
+
+	It("should warn when a pool is nearly exhausted or the requested IP is taken", func() {
+		// small有5个可分配的IP，用掉4个达到80%
+		for i, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+			ok, err := store.Reserve(&backend.Allocation{ContainerID: string(rune('a' + i)), IfName: "eth0"}, net.ParseIP(ip), "small")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		}
+		resp := validator.Review(podRequest(map[string]string{"app_net": "small", "ts-cni/requested-ip": "10.0.0.2"}))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Warnings).To(ConsistOf(
+			ContainSubstring("10.0.0.2 has been allocated"),
+			ContainSubstring("small is nearly exhausted: 4/5"),
+		))
+
+		resp = validator.Review(podRequest(map[string]string{"app_net": "big"}))
+		Expect(resp.Warnings).To(BeEmpty())
+	})
+})